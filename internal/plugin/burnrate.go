@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+const (
+	// roleTotal prefixes the roles of the queries counting every event of a burn rate window
+	roleTotal = "total"
+	// roleGood prefixes the roles of the queries counting the good events of a burn rate window
+	roleGood = "good"
+)
+
+// BurnRateSpec measures the burn rate of an SLO target over pairs of a short and a long window, as in the multiwindow,
+// multi-burn-rate alerts of the Google SRE workbook. A measurement fails when both windows of any pair burn the error
+// budget faster than the threshold of the pair.
+type BurnRateSpec struct {
+	// Filters select the events the SLO is about, every one of them counts towards the total
+	Filters []Filter `json:"filters,omitempty" protobuf:"bytes,1,rep,name=filters"`
+	// Good selects the good events among the events selected by Filters
+	Good []Filter `json:"good" protobuf:"bytes,2,rep,name=good"`
+	// Target is the percentage of good events the SLO aims for, e.g. 99.9
+	Target float64 `json:"target" protobuf:"fixed64,3,opt,name=target"`
+	// Windows are the pairs of windows the burn rate is measured over
+	Windows []BurnRateWindow `json:"windows" protobuf:"bytes,4,rep,name=windows"`
+}
+
+// BurnRateWindow is a pair of windows whose burn rates must both exceed the threshold for the measurement to fail.
+// The long window detects a significant burn, the short window that it is still ongoing.
+type BurnRateWindow struct {
+	// Short is the short window, e.g. 5m
+	Short string `json:"short" protobuf:"bytes,1,opt,name=short"`
+	// Long is the long window, e.g. 1h
+	Long string `json:"long" protobuf:"bytes,2,opt,name=long"`
+	// Threshold is the burn rate both windows must exceed, e.g. 14.4
+	Threshold float64 `json:"threshold" protobuf:"fixed64,3,opt,name=threshold"`
+}
+
+func (b *BurnRateSpec) validate() error {
+	for i, filter := range b.Filters {
+		if err := validateFilter(filter); err != nil {
+			return fmt.Errorf("filters[%d]: %w", i, err)
+		}
+	}
+
+	if len(b.Good) == 0 {
+		return errors.New("at least one good filter must be specified")
+	}
+	for i, filter := range b.Good {
+		if err := validateFilter(filter); err != nil {
+			return fmt.Errorf("good[%d]: %w", i, err)
+		}
+	}
+
+	if b.Target <= 0 || b.Target >= 100 {
+		return errors.New("target must be between 0 and 100")
+	}
+
+	if len(b.Windows) == 0 {
+		return errors.New("at least one window must be specified")
+	}
+	for i, window := range b.Windows {
+		if err := window.validate(); err != nil {
+			return fmt.Errorf("windows[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (w BurnRateWindow) validate() error {
+	short, err := parseBurnRateWindow(w.Short)
+	if err != nil {
+		return fmt.Errorf("short is invalid: %w", err)
+	}
+	long, err := parseBurnRateWindow(w.Long)
+	if err != nil {
+		return fmt.Errorf("long is invalid: %w", err)
+	}
+	if short >= long {
+		return errors.New("short must be shorter than long")
+	}
+	if w.Threshold <= 0 {
+		return errors.New("threshold must be positive")
+	}
+	return nil
+}
+
+// parseBurnRateWindow parses a window, which honeycomb queries in whole seconds
+func parseBurnRateWindow(window string) (time.Duration, error) {
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, errors.New("must be at least 1s")
+	}
+	return d, nil
+}
+
+// windows returns every window of the pairs once, in order
+func (b *BurnRateSpec) windows() []string {
+	var windows []string
+	seen := make(map[string]bool)
+	for _, pair := range b.Windows {
+		for _, window := range []string{pair.Short, pair.Long} {
+			if !seen[window] {
+				seen[window] = true
+				windows = append(windows, window)
+			}
+		}
+	}
+	return windows
+}
+
+// queries returns the queries counting every event and the good events over each window, rendered with the
+// AnalysisRun context
+func (b *BurnRateSpec) queries(qc *queryContext, calculatedFields []CalculatedField) ([]measurementQuery, error) {
+	var queries []measurementQuery
+	for _, window := range b.windows() {
+		// validated by parseConfig
+		d, _ := parseBurnRateWindow(window)
+		for _, role := range []string{roleTotal, roleGood} {
+			query := Query{
+				Calculations:     []Calculation{{Op: countOp}},
+				Filters:          b.Filters,
+				TimeRange:        int(d / time.Second),
+				CalculatedFields: calculatedFields,
+			}
+			if role == roleGood {
+				query.Filters = append(append([]Filter{}, b.Filters...), b.Good...)
+			}
+			if len(query.Filters) > 0 {
+				query.FilterCombo = "AND"
+			}
+
+			rendered, err := renderQuerySpec(&query, qc)
+			if err != nil {
+				return nil, err
+			}
+			text, err := json.Marshal(rendered)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal burn rate query: %w", err)
+			}
+			queries = append(queries, measurementQuery{role: role + "." + window, text: string(text)})
+		}
+	}
+	return queries, nil
+}
+
+// burnRates returns the burn rate over every window from the query results by role. The burn rate is the ratio of
+// bad events over the window to the ratio the target allows. empty is the first window without events, if any.
+func (b *BurnRateSpec) burnRates(results map[string]*QueryResult) (rates map[string]float64, empty string, err error) {
+	budget := 1 - b.Target/100
+	rates = make(map[string]float64)
+	for _, window := range b.windows() {
+		total, err := countEvents(results[roleTotal+"."+window])
+		if err != nil {
+			return nil, "", err
+		}
+		if total == 0 {
+			return nil, window, nil
+		}
+		good, err := countEvents(results[roleGood+"."+window])
+		if err != nil {
+			return nil, "", err
+		}
+		rates[window] = (1 - good/total) / budget
+	}
+	return rates, "", nil
+}
+
+// evaluate evaluates the burn rates over the windows of every pair. Measurements which do not fail are evaluated
+// against the conditions of the metric, if any.
+func (b *BurnRateSpec) evaluate(metric v1alpha1.Metric, results map[string]*QueryResult) (evaluation, error) {
+	rates, empty, err := b.burnRates(results)
+	if err != nil {
+		return evaluation{}, err
+	}
+	if empty != "" {
+		// without events, nothing can be said about the burn rate
+		return evaluation{
+			phase:   v1alpha1.AnalysisPhaseInconclusive,
+			message: fmt.Sprintf("no events in the %s window", empty),
+		}, nil
+	}
+
+	values := make([]string, 0, len(rates))
+	for _, window := range b.windows() {
+		values = append(values, formatBurnRate(window, rates[window]))
+	}
+	e := evaluation{
+		value: strings.Join(values, ", "),
+	}
+
+	var exceeded []string
+	for _, pair := range b.Windows {
+		if rates[pair.Short] > pair.Threshold && rates[pair.Long] > pair.Threshold {
+			exceeded = append(exceeded, fmt.Sprintf("%s and %s exceed %s", pair.Short, pair.Long, formatCalculationValue(pair.Threshold)))
+		}
+	}
+	if len(exceeded) > 0 {
+		e.phase = v1alpha1.AnalysisPhaseFailed
+		e.message = "burn rates over " + strings.Join(exceeded, "; ")
+		return e, nil
+	}
+
+	if metric.SuccessCondition == "" && metric.FailureCondition == "" {
+		e.phase = v1alpha1.AnalysisPhaseSuccessful
+		return e, nil
+	}
+
+	c, err := compileConditions(metric)
+	if err != nil {
+		return e, err
+	}
+	e.phase, err = c.evaluate(envStruct{
+		BurnRate:  rates[b.Windows[0].Short],
+		BurnRates: rates,
+	})
+	return e, err
+}
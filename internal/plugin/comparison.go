@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// roleBaseline is the role of the query of the baseline in comparison mode
+	roleBaseline = "baseline"
+)
+
+const (
+	// ComparisonTestMannWhitney compares canary and baseline with the Mann-Whitney U test
+	ComparisonTestMannWhitney = "mann-whitney"
+	// ComparisonTestWelch compares canary and baseline with Welch's t-test
+	ComparisonTestWelch = "welch"
+)
+
+// Comparison runs the query of a metric twice, once for the events of the canary and once for the events of the
+// baseline, which are told apart by the value of a column. With Breakdown, the query runs once, broken down by the
+// column, and the canary and baseline are groups of its result.
+type Comparison struct {
+	// Column tells canary and baseline events apart, e.g. a pod-template-hash or version column
+	Column string `json:"column" protobuf:"bytes,1,opt,name=column"`
+	// Canary is the value of the column on events of the canary
+	Canary string `json:"canary" protobuf:"bytes,2,opt,name=canary"`
+	// Baseline is the value of the column on events of the baseline
+	Baseline string `json:"baseline" protobuf:"bytes,3,opt,name=baseline"`
+	// Test is the significance test whose results are pValue and effectSize, mann-whitney by default. Both tests are
+	// run between the series of the canary and of the baseline, and available as mannWhitney and welch.
+	Test string `json:"test,omitempty" protobuf:"bytes,4,opt,name=test"`
+	// Breakdown compares the canary and baseline groups of a single query broken down by the column instead of running
+	// the query twice
+	Breakdown bool `json:"breakdown,omitempty" protobuf:"varint,5,opt,name=breakdown"`
+}
+
+func (c *Comparison) validate() error {
+	if c.Column == "" {
+		return errors.New("column must be specified")
+	}
+	if c.Canary == "" || c.Baseline == "" {
+		return errors.New("canary and baseline values must be specified")
+	}
+	if c.Canary == c.Baseline {
+		return errors.New("canary and baseline values must differ")
+	}
+	switch c.Test {
+	case "", ComparisonTestMannWhitney, ComparisonTestWelch:
+	default:
+		return fmt.Errorf("test must be one of %s or %s", ComparisonTestMannWhitney, ComparisonTestWelch)
+	}
+	return nil
+}
+
+// significance runs both significance tests between the samples of the canary and of the baseline, and returns them
+// along with the test of the comparison
+func (c *Comparison) significance(canary []float64, baseline []float64) (selected testResult, mannWhitney testResult, welch testResult) {
+	mannWhitney = mannWhitneyU(canary, baseline)
+	welch = welchT(canary, baseline)
+	if c.Test == ComparisonTestWelch {
+		return welch, mannWhitney, welch
+	}
+	return mannWhitney, mannWhitney, welch
+}
+
+// measurementQuery is one of the honeycomb queries run for a measurement
+type measurementQuery struct {
+	// role tells the queries of a measurement apart, the main query has no role
+	role string
+	text string
+}
+
+// measurementQueries returns the honeycomb queries to run for a measurement of the metric, rendered with the
+// AnalysisRun context and limited to the window of the measurement when there are some
+func (c *Config) measurementQueries(qc *queryContext, tw *timeWindow) ([]measurementQuery, error) {
+	if c.BurnRate != nil {
+		return c.BurnRate.queries(qc, c.CalculatedFields)
+	}
+	if c.savedQuery() {
+		// the text of saved queries is not known without asking honeycomb, they run as they are
+		return []measurementQuery{{}}, nil
+	}
+
+	text, err := c.queryText(qc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.CalculatedFields) > 0 {
+		text, err = withCalculatedFields(text, c.CalculatedFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.MinSamples > 0 || c.Freshness != nil {
+		text, err = withCount(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tw != nil {
+		text, err = withWindow(text, *tw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Comparison == nil {
+		return []measurementQuery{{text: text}}, nil
+	}
+
+	if c.Comparison.Breakdown {
+		text, err = withFilter(text, Filter{Column: &c.Comparison.Column, Op: "in", Value: []string{c.Comparison.Canary, c.Comparison.Baseline}})
+		if err != nil {
+			return nil, err
+		}
+		text, err = withBreakdown(text, c.Comparison.Column)
+		if err != nil {
+			return nil, err
+		}
+		// both groups are measured by the main query
+		return []measurementQuery{{text: text}}, nil
+	}
+
+	canary, err := withFilter(text, Filter{Column: &c.Comparison.Column, Op: "=", Value: c.Comparison.Canary})
+	if err != nil {
+		return nil, err
+	}
+	baseline, err := withFilter(text, Filter{Column: &c.Comparison.Column, Op: "=", Value: c.Comparison.Baseline})
+	if err != nil {
+		return nil, err
+	}
+
+	// the canary is measured by the main query
+	return []measurementQuery{
+		{text: canary},
+		{role: roleBaseline, text: baseline},
+	}, nil
+}
+
+// withFilter adds a filter to a raw honeycomb query. Members of the query the plugin does not know about are kept.
+func withFilter(query string, filter Filter) (string, error) {
+	return updateQuery(query, func(q map[string]interface{}) error {
+		if combination, _ := q["filter_combination"].(string); combination == "OR" {
+			return errors.New("filters cannot be added to a query with an OR filter_combination")
+		}
+
+		filters, _ := q["filters"].([]interface{})
+		q["filters"] = append(filters, filter)
+		return nil
+	})
+}
+
+// withBreakdown adds a breakdown to a raw honeycomb query, unless the query is already broken down by the column
+func withBreakdown(query string, column string) (string, error) {
+	return updateQuery(query, func(q map[string]interface{}) error {
+		breakdowns, _ := q["breakdowns"].([]interface{})
+		if slices.Contains(breakdowns, interface{}(column)) {
+			return nil
+		}
+		q["breakdowns"] = append(breakdowns, column)
+		return nil
+	})
+}
+
+// splitGroups splits the result of a query broken down by the column of the comparison into the result of the canary
+// and the result of the baseline, without the column in their breakdowns so that their groups match. Rows and buckets
+// of other values of the column are left out.
+func (c *Comparison) splitGroups(result *QueryResult) (canary *QueryResult, baseline *QueryResult) {
+	ca := *result
+	ca.Query.Breakdowns = slices.DeleteFunc(slices.Clone(result.Query.Breakdowns), func(breakdown string) bool {
+		return breakdown == c.Column
+	})
+	ca.Data = QueryResultData{}
+	ba := ca
+
+	for _, datum := range result.Data.Results {
+		switch formatCalculationValue(datum.Data[c.Column]) {
+		case c.Canary:
+			ca.Data.Results = append(ca.Data.Results, datum)
+		case c.Baseline:
+			ba.Data.Results = append(ba.Data.Results, datum)
+		}
+	}
+	for _, datum := range result.Data.Series {
+		data, _ := datum.Data.(map[string]interface{})
+		switch formatCalculationValue(data[c.Column]) {
+		case c.Canary:
+			ca.Data.Series = append(ca.Data.Series, datum)
+		case c.Baseline:
+			ba.Data.Series = append(ba.Data.Series, datum)
+		}
+	}
+	return &ca, &ba
+}
+
+// roleKey returns the metadata key of the role, which is the key itself for the main query
+func roleKey(key string, role string) string {
+	if role == "" {
+		return key
+	}
+	return key + "." + role
+}
@@ -0,0 +1,297 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+const (
+	// PluginName is the name the plugin is registered with in the argo-rollouts configmap
+	PluginName = "argoproj-labs/honeycomb"
+)
+
+const (
+	// NullValuesSkip ignores results without a value for the calculation
+	NullValuesSkip = "skip"
+	// NullValuesZero evaluates results without a value for the calculation as zero
+	NullValuesZero = "zero"
+	// NullValuesInconclusive marks the measurement inconclusive when a result has no value for the calculation
+	NullValuesInconclusive = "inconclusive"
+)
+
+const (
+	// GroupPolicyAll succeeds when every group of a query with breakdowns succeeds
+	GroupPolicyAll = "all"
+	// GroupPolicyAny fails as soon as any group of a query with breakdowns fails
+	GroupPolicyAny = "any"
+	// GroupPolicyMajority takes the phase of the majority of the groups of a query with breakdowns
+	GroupPolicyMajority = "majority"
+)
+
+type Config struct {
+	// Query is a raw honeycomb query to perform
+	Query string `json:"query,omitempty" protobuf:"bytes,1,opt,name=query"`
+	// QuerySpec is a structured honeycomb query to perform instead of Query, validated when the config is parsed
+	QuerySpec *Query `json:"querySpec,omitempty" protobuf:"bytes,9,opt,name=querySpec"`
+	// QueryID is the ID of a query saved in honeycomb to perform as it is instead of Query
+	QueryID string `json:"queryID,omitempty" protobuf:"bytes,19,opt,name=queryID"`
+	// QueryAnnotation is the name of a query annotation whose query to perform as it is instead of Query
+	QueryAnnotation string `json:"queryAnnotation,omitempty" protobuf:"bytes,20,opt,name=queryAnnotation"`
+	// Dataset is the name of the honeycomb dataset to query
+	Dataset string `json:"dataset,omitempty" protobuf:"bytes,2,opt,name=dataset"`
+	// APIKey is the honeycomb API key to use for authentication
+	APIKey string `json:"apiKey,omitempty" protobuf:"bytes,3,opt,name=apiKey"`
+	// APIKeySecretRef references the secret in the argo-rollouts namespace holding the honeycomb API key.
+	// It is used when APIKey is not set and defaults to the api-key key of the honeycomb secret.
+	APIKeySecretRef *SecretKeyRef `json:"apiKeySecretRef,omitempty" protobuf:"bytes,4,opt,name=apiKeySecretRef"`
+	// NullValues is how results without a value for the calculation are handled: skip (default), zero or inconclusive
+	NullValues string `json:"nullValues,omitempty" protobuf:"bytes,5,opt,name=nullValues"`
+	// Aliases names calculations of the query, e.g. errors: COUNT, so they can be referred to as results["errors"]
+	Aliases map[string]string `json:"aliases,omitempty" protobuf:"bytes,6,rep,name=aliases"`
+	// GroupPolicy is how the groups of a query with breakdowns decide the measurement: all (default), any or majority
+	GroupPolicy string `json:"groupPolicy,omitempty" protobuf:"bytes,7,opt,name=groupPolicy"`
+	// APIURL is the base URL of the honeycomb API, e.g. https://api.eu1.honeycomb.io. Defaults to the plugin-wide
+	// default, which is https://api.honeycomb.io unless the HONEYCOMB_API_URL environment variable is set.
+	APIURL string `json:"apiURL,omitempty" protobuf:"bytes,8,opt,name=apiURL"`
+	// Comparison compares the canary with the baseline by running the query once for each of them
+	Comparison *Comparison `json:"comparison,omitempty" protobuf:"bytes,10,opt,name=comparison"`
+	// Window makes every measurement query the events since the previous measurement
+	Window *Window `json:"window,omitempty" protobuf:"bytes,11,opt,name=window"`
+	// CalculatedFields are derived columns added to the query, e.g. to calculate an error rate
+	CalculatedFields []CalculatedField `json:"calculatedFields,omitempty" protobuf:"bytes,12,rep,name=calculatedFields"`
+	// MinSamples is the number of events below which a measurement is Inconclusive instead of evaluated
+	MinSamples int `json:"minSamples,omitempty" protobuf:"varint,13,opt,name=minSamples"`
+	// Freshness checks that the query result has recent events
+	Freshness *Freshness `json:"freshness,omitempty" protobuf:"bytes,14,opt,name=freshness"`
+	// SLO evaluates a honeycomb SLO instead of a query
+	SLO *SLOSpec `json:"slo,omitempty" protobuf:"bytes,15,opt,name=slo"`
+	// BurnRate evaluates the burn rate of an SLO target over pairs of windows instead of a query
+	BurnRate *BurnRateSpec `json:"burnRate,omitempty" protobuf:"bytes,16,opt,name=burnRate"`
+	// Triggers are the IDs of honeycomb triggers which must not be triggered, checked instead of a query
+	Triggers []string `json:"triggers,omitempty" protobuf:"bytes,17,rep,name=triggers"`
+	// Markers creates a deploy marker in honeycomb for every AnalysisRun
+	Markers *Markers `json:"markers,omitempty" protobuf:"bytes,18,opt,name=markers"`
+}
+
+// SecretKeyRef selects a key of a secret in the argo-rollouts namespace
+type SecretKeyRef struct {
+	// Name is the name of the secret
+	Name string `json:"name,omitempty" protobuf:"bytes,1,opt,name=name"`
+	// Key is the key of the secret holding the value
+	Key string `json:"key,omitempty" protobuf:"bytes,2,opt,name=key"`
+}
+
+// parseConfig reads the honeycomb plugin config from the metric provider and validates it
+func parseConfig(metric v1alpha1.Metric) (*Config, error) {
+	pluginConfig, ok := metric.Provider.Plugin[PluginName]
+	if !ok {
+		return nil, errors.New("unable to find honeycomb plugin config")
+	}
+
+	var config Config
+	if err := json.Unmarshal(pluginConfig, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse honeycomb plugin config: %w", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid honeycomb plugin config: %w", err)
+	}
+
+	if len(config.Triggers) > 0 && (metric.SuccessCondition != "" || metric.FailureCondition != "") {
+		// triggers carry their own thresholds
+		return nil, errors.New("invalid honeycomb plugin config: successCondition and failureCondition cannot be used with triggers")
+	}
+
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	sources := 0
+	for _, set := range []bool{c.Query != "", c.QuerySpec != nil, c.QueryID != "", c.QueryAnnotation != "", c.SLO != nil, c.BurnRate != nil, len(c.Triggers) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return errors.New("one of query, querySpec, queryID, queryAnnotation, slo, burnRate or triggers must be specified")
+	}
+	if sources > 1 {
+		return errors.New("only one of query, querySpec, queryID, queryAnnotation, slo, burnRate and triggers can be specified")
+	}
+
+	if c.SLO != nil {
+		if err := c.SLO.validate(); err != nil {
+			return fmt.Errorf("slo is invalid: %w", err)
+		}
+	}
+
+	if c.BurnRate != nil {
+		if err := c.BurnRate.validate(); err != nil {
+			return fmt.Errorf("burnRate is invalid: %w", err)
+		}
+	}
+
+	if len(c.Triggers) > 0 {
+		if err := validateTriggers(c.Triggers); err != nil {
+			return err
+		}
+	}
+
+	if c.Query == "" && c.QuerySpec == nil {
+		// saved queries run as they are and the other sources build their own queries
+		if options := c.queryOptionsSet(); len(options) > 0 {
+			return fmt.Errorf("%s can only be used with query or querySpec", strings.Join(options, ", "))
+		}
+	}
+
+	if c.QuerySpec != nil {
+		if err := validateQuery(c.QuerySpec); err != nil {
+			return fmt.Errorf("querySpec is invalid: %w", err)
+		}
+	}
+
+	for i, field := range c.CalculatedFields {
+		if err := validateCalculatedField(field); err != nil {
+			return fmt.Errorf("calculatedFields[%d] is invalid: %w", i, err)
+		}
+	}
+	if c.QuerySpec != nil {
+		fields := append(slices.Clone(c.QuerySpec.CalculatedFields), c.CalculatedFields...)
+		if err := validateCalculatedFields(fields, c.QuerySpec.Calculations); err != nil {
+			return err
+		}
+	}
+
+	if c.APIKey != "" && c.APIKeySecretRef != nil {
+		return errors.New("only one of apiKey and apiKeySecretRef can be specified")
+	}
+
+	switch c.NullValues {
+	case "", NullValuesSkip, NullValuesZero, NullValuesInconclusive:
+	default:
+		return fmt.Errorf("nullValues must be one of %s, %s or %s", NullValuesSkip, NullValuesZero, NullValuesInconclusive)
+	}
+
+	switch c.GroupPolicy {
+	case "", GroupPolicyAll, GroupPolicyAny, GroupPolicyMajority:
+	default:
+		return fmt.Errorf("groupPolicy must be one of %s, %s or %s", GroupPolicyAll, GroupPolicyAny, GroupPolicyMajority)
+	}
+
+	if c.APIURL != "" {
+		if err := validateAPIURL(c.APIURL); err != nil {
+			return fmt.Errorf("apiURL is invalid: %w", err)
+		}
+	}
+
+	if c.Comparison != nil {
+		if err := c.Comparison.validate(); err != nil {
+			return fmt.Errorf("comparison is invalid: %w", err)
+		}
+		if c.QuerySpec != nil && c.QuerySpec.FilterCombo == "OR" {
+			return errors.New("comparison requires the AND filter_combination")
+		}
+	}
+
+	if c.Window != nil {
+		if err := c.Window.validate(); err != nil {
+			return fmt.Errorf("window is invalid: %w", err)
+		}
+	}
+
+	if c.MinSamples < 0 {
+		return errors.New("minSamples cannot be negative")
+	}
+
+	if c.Freshness != nil {
+		if err := c.Freshness.validate(); err != nil {
+			return fmt.Errorf("freshness is invalid: %w", err)
+		}
+	}
+
+	for alias, name := range c.Aliases {
+		if alias == "" || name == "" {
+			return errors.New("aliases must map a non-empty alias to a calculation name")
+		}
+	}
+
+	return nil
+}
+
+// queryOptionsSet returns the options set which only apply to a query defined in the config. Calculated fields are
+// added to the queries of burn rates too.
+func (c *Config) queryOptionsSet() []string {
+	var options []string
+	if c.Comparison != nil {
+		options = append(options, "comparison")
+	}
+	if c.Window != nil {
+		options = append(options, "window")
+	}
+	if len(c.CalculatedFields) > 0 && c.BurnRate == nil {
+		options = append(options, "calculatedFields")
+	}
+	if c.MinSamples != 0 {
+		options = append(options, "minSamples")
+	}
+	if c.Freshness != nil {
+		options = append(options, "freshness")
+	}
+	return options
+}
+
+// queryText returns the query to send to honeycomb rendered with the AnalysisRun context, serializing the structured
+// query specification if there is one
+func (c *Config) queryText(qc *queryContext) (string, error) {
+	if c.QuerySpec == nil {
+		return renderQuery(c.Query, qc)
+	}
+
+	spec, err := renderQuerySpec(c.QuerySpec, qc)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal querySpec: %w", err)
+	}
+	return string(b), nil
+}
+
+// secretKeyRef returns the secret holding the API key, with the defaults applied
+func (c *Config) secretKeyRef() SecretKeyRef {
+	ref := SecretKeyRef{
+		Name: HoneycombSecret,
+		Key:  HoneycombAPIKey,
+	}
+	if c.APIKeySecretRef != nil {
+		if c.APIKeySecretRef.Name != "" {
+			ref.Name = c.APIKeySecretRef.Name
+		}
+		if c.APIKeySecretRef.Key != "" {
+			ref.Key = c.APIKeySecretRef.Key
+		}
+	}
+	return ref
+}
+
+// validateAPIURL checks that the base URL of the honeycomb API is an absolute http(s) URL
+func validateAPIURL(apiURL string) error {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
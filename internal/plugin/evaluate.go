@@ -0,0 +1,528 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// envStruct is the environment the success and failure conditions are evaluated in, once for every group of the
+// query result
+type envStruct struct {
+	// Result is the value of the first calculation of the query
+	Result float64 `expr:"result"`
+	// Results holds the value of every calculation of the query by name, e.g. P99(duration_ms), and by alias
+	Results map[string]float64 `expr:"results"`
+	// Group holds the breakdown values of the group, e.g. group["service.name"]
+	Group map[string]interface{} `expr:"group"`
+	// Series holds the value of the first calculation in every bucket of the group, ordered by time
+	Series []seriesPoint `expr:"series"`
+	// Canary is the result of the canary in comparison mode, the same as Result
+	Canary float64 `expr:"canary"`
+	// Baseline is the result of the baseline group with the same breakdown values in comparison mode
+	Baseline float64 `expr:"baseline"`
+	// PValue is the p-value of the significance test selected by the comparison between the series of canary and
+	// baseline in comparison mode
+	PValue float64 `expr:"pValue"`
+	// EffectSize is the effect size of the significance test, positive when the canary is larger than the baseline
+	EffectSize float64 `expr:"effectSize"`
+	// MannWhitney is the Mann-Whitney U test between the series of canary and baseline in comparison mode
+	MannWhitney significanceTest `expr:"mannWhitney"`
+	// Welch is Welch's t-test between the series of canary and baseline in comparison mode
+	Welch significanceTest `expr:"welch"`
+	// Previous is the result of the group over the offset period of a query with a compare_time_offset_seconds
+	Previous float64 `expr:"previous"`
+	// PreviousResults holds the value of every calculation of the group over the offset period, like Results
+	PreviousResults map[string]float64 `expr:"previousResults"`
+	// BudgetRemaining is the percentage of the error budget of the SLO left in slo mode
+	BudgetRemaining float64 `expr:"budgetRemaining"`
+	// BurnRate is the burn rate over the first burn rate window in slo mode, or the first short window in burnRate mode
+	BurnRate float64 `expr:"burnRate"`
+	// BurnRates holds the burn rate by window in slo and burnRate modes, e.g. burnRates["6h"]
+	BurnRates map[string]float64 `expr:"burnRates"`
+	// Compliance is the percentage of good events of the SLO over its time period in slo mode
+	Compliance float64 `expr:"compliance"`
+}
+
+// significanceTest is the outcome of a significance test between canary and baseline, e.g. welch.pValue
+type significanceTest struct {
+	// Statistic is the test statistic, U for Mann-Whitney and t for Welch
+	Statistic float64 `expr:"statistic"`
+	// PValue is the two-sided p-value of the test
+	PValue float64 `expr:"pValue"`
+	// EffectSize is the rank-biserial correlation for Mann-Whitney and Cohen's d for Welch, positive when the canary
+	// is larger than the baseline
+	EffectSize float64 `expr:"effectSize"`
+}
+
+// evaluation is the outcome of evaluating a query result against the conditions of a metric
+type evaluation struct {
+	value   string
+	phase   v1alpha1.AnalysisPhase
+	message string
+	// metadata is added to the metadata of the measurement
+	metadata map[string]string
+}
+
+// group is a result of the query for one combination of breakdown values
+type group struct {
+	label string
+	env   envStruct
+}
+
+// calculationName returns the name honeycomb uses for the calculation in query results
+func calculationName(calculation Calculation) string {
+	if calculation.Column != nil {
+		return fmt.Sprintf("%s(%s)", calculation.Op, *calculation.Column)
+	}
+	return calculation.Op
+}
+
+// calculationValue converts the value of a calculation in a query result to a float64. ok is false when the
+// calculation has no value.
+func calculationValue(value interface{}) (result float64, ok bool, err error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, false, nil
+	case json.Number:
+		result, err = v.Float64()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to parse calculation value %q: %w", v, err)
+		}
+		return result, true, nil
+	case float64:
+		return v, true, nil
+	case float32:
+		return float64(v), true, nil
+	case int:
+		return float64(v), true, nil
+	case int64:
+		return float64(v), true, nil
+	default:
+		return 0, false, fmt.Errorf("unexpected calculation value %v of type %T", v, v)
+	}
+}
+
+// formatCalculationValue formats the value of a calculation in a query result as it was returned by honeycomb
+func formatCalculationValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// breakdownValues returns the breakdown values of a query result, with numbers converted to float64 so that
+// they can be compared in conditions
+func breakdownValues(breakdowns []string, data map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(breakdowns))
+	for _, breakdown := range breakdowns {
+		value := data[breakdown]
+		if number, ok := value.(json.Number); ok {
+			if f, err := number.Float64(); err == nil {
+				value = f
+			}
+		}
+		values[breakdown] = value
+	}
+	return values
+}
+
+// groupLabel returns a readable name of the group, e.g. service.name=api,region=eu
+func groupLabel(breakdowns []string, data map[string]interface{}) string {
+	parts := make([]string, len(breakdowns))
+	for i, breakdown := range breakdowns {
+		parts[i] = fmt.Sprintf("%s=%s", breakdown, formatCalculationValue(data[breakdown]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// conditions are the compiled success and failure conditions of a metric
+type conditions struct {
+	success *vm.Program
+	failure *vm.Program
+}
+
+func compileConditions(metric v1alpha1.Metric) (*conditions, error) {
+	options := append([]expr.Option{expr.Env(envStruct{})}, seriesFunctions...)
+
+	var c conditions
+	var err error
+	if metric.SuccessCondition != "" {
+		c.success, err = expr.Compile(metric.SuccessCondition, options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if metric.FailureCondition != "" {
+		c.failure, err = expr.Compile(metric.FailureCondition, options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
+
+func runCondition(program *vm.Program, env envStruct) (bool, error) {
+	output, err := expr.Run(program, env)
+	if err != nil {
+		return false, err
+	}
+
+	switch val := output.(type) {
+	case bool:
+		return val, nil
+	default:
+		return false, fmt.Errorf("expected bool, but got %T", val)
+	}
+}
+
+// evaluate returns the phase of a single group
+func (c *conditions) evaluate(env envStruct) (v1alpha1.AnalysisPhase, error) {
+	successCondition := false
+	failCondition := false
+	var err error
+
+	if c.success != nil {
+		successCondition, err = runCondition(c.success, env)
+		if err != nil {
+			return v1alpha1.AnalysisPhaseError, err
+		}
+	}
+
+	if c.failure != nil {
+		failCondition, err = runCondition(c.failure, env)
+		if err != nil {
+			return v1alpha1.AnalysisPhaseError, err
+		}
+	}
+
+	switch {
+	case c.success != nil && c.failure == nil:
+		// Without a failure condition, a measurement is considered a failure if the measurement's success condition is not true
+		failCondition = !successCondition
+	case c.success == nil && c.failure != nil:
+		// Without a success condition, a measurement is considered a successful if the measurement's failure condition is not true
+		successCondition = !failCondition
+	}
+
+	if failCondition {
+		return v1alpha1.AnalysisPhaseFailed, nil
+	}
+
+	if !failCondition && !successCondition {
+		return v1alpha1.AnalysisPhaseInconclusive, nil
+	}
+
+	return v1alpha1.AnalysisPhaseSuccessful, nil
+}
+
+// aggregatePhases combines the phases of every group into the phase of the measurement according to the group policy
+func aggregatePhases(policy string, phases []v1alpha1.AnalysisPhase) v1alpha1.AnalysisPhase {
+	successful := 0
+	failed := 0
+	for _, phase := range phases {
+		switch phase {
+		case v1alpha1.AnalysisPhaseSuccessful:
+			successful++
+		case v1alpha1.AnalysisPhaseFailed:
+			failed++
+		}
+	}
+
+	switch policy {
+	case GroupPolicyAny:
+		if failed > 0 {
+			return v1alpha1.AnalysisPhaseFailed
+		}
+		if successful > 0 {
+			return v1alpha1.AnalysisPhaseSuccessful
+		}
+	case GroupPolicyMajority:
+		if failed*2 > len(phases) {
+			return v1alpha1.AnalysisPhaseFailed
+		}
+		if successful*2 > len(phases) {
+			return v1alpha1.AnalysisPhaseSuccessful
+		}
+	default:
+		if failed > 0 {
+			return v1alpha1.AnalysisPhaseFailed
+		}
+		if successful == len(phases) {
+			return v1alpha1.AnalysisPhaseSuccessful
+		}
+	}
+
+	return v1alpha1.AnalysisPhaseInconclusive
+}
+
+// extractGroups returns the groups of a query result, without the groups skipped because of null values, along with
+// the value of the first calculation of every group as returned by honeycomb and whether any value was null
+func extractGroups(config *Config, names []string, result *QueryResult) (groups []group, values []string, hasNull bool, err error) {
+	breakdowns := result.Query.Breakdowns
+	series, err := groupSeries(result, names[0])
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	groups = make([]group, 0, len(result.Data.Results))
+	values = make([]string, len(result.Data.Results))
+
+	for i, datum := range result.Data.Results {
+		// the measurement value shows the first calculation
+		values[i] = formatCalculationValue(datum.Data[names[0]])
+
+		env := envStruct{
+			Results: make(map[string]float64, len(names)+len(config.Aliases)),
+			Group:   breakdownValues(breakdowns, datum.Data),
+		}
+		skip := false
+		for _, name := range names {
+			value, ok, err := calculationValue(datum.Data[name])
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if !ok {
+				hasNull = true
+				skip = config.NullValues != NullValuesZero
+			}
+			env.Results[name] = value
+		}
+		if skip {
+			continue
+		}
+
+		label := groupLabel(breakdowns, datum.Data)
+		env.Result = env.Results[names[0]]
+		env.Series = series[label]
+		for alias, name := range config.Aliases {
+			env.Results[alias] = env.Results[name]
+		}
+		groups = append(groups, group{
+			label: label,
+			env:   env,
+		})
+	}
+
+	return groups, values, hasNull, nil
+}
+
+// compareGroups sets the canary and baseline values of every canary group, matching baseline groups by their
+// breakdown values, along with the significance tests between their series. A canary group without a baseline group is
+// handled like a null value.
+func compareGroups(config *Config, canary []group, baseline []group) (groups []group, hasNull bool) {
+	baselines := make(map[string]envStruct, len(baseline))
+	for _, g := range baseline {
+		baselines[g.label] = g.env
+	}
+
+	groups = make([]group, 0, len(canary))
+	for _, g := range canary {
+		b, ok := baselines[g.label]
+		if !ok {
+			hasNull = true
+			if config.NullValues != NullValuesZero {
+				continue
+			}
+		}
+		g.env.Canary = g.env.Result
+		g.env.Baseline = b.Result
+		test, mannWhitney, welch := config.Comparison.significance(seriesValues(g.env.Series), seriesValues(b.Series))
+		g.env.PValue = test.pValue
+		g.env.EffectSize = test.effectSize
+		g.env.MannWhitney = mannWhitney.env()
+		g.env.Welch = welch.env()
+		groups = append(groups, g)
+	}
+	return groups, hasNull
+}
+
+// countEvents returns the number of events counted by the COUNT calculation of the query result, which withCount
+// adds to queries for minSamples
+func countEvents(result *QueryResult) (float64, error) {
+	var events float64
+	for _, datum := range result.Data.Results {
+		count, _, err := calculationValue(datum.Data[countOp])
+		if err != nil {
+			return 0, err
+		}
+		events += count
+	}
+	return events, nil
+}
+
+// formatValues formats the values of a query result as the value of a measurement
+func formatValues(values []string) string {
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+// processResponse evaluates the query results of a measurement by role against the conditions of the metric
+func (p *HoneycombProvider) processResponse(metric v1alpha1.Metric, config *Config, results map[string]*QueryResult) (evaluation, error) {
+	if config.BurnRate != nil {
+		return config.BurnRate.evaluate(metric, results)
+	}
+
+	if config.Comparison != nil && config.Comparison.Breakdown {
+		// the canary and the baseline are groups of the main query
+		canary, baseline := config.Comparison.splitGroups(results[""])
+		results = map[string]*QueryResult{"": canary, roleBaseline: baseline}
+	}
+
+	result, previousResult := splitTimeOffset(results[""])
+	if len(result.Data.Results) == 0 {
+		return evaluation{}, errors.New("no results returned")
+	}
+
+	if len(result.Query.Calculations) == 0 {
+		// this shouldn't happen, but just in case
+		return evaluation{}, errors.New("no calculations specifed in query")
+	}
+
+	names := make([]string, len(result.Query.Calculations))
+	for i, calculation := range result.Query.Calculations {
+		names[i] = calculationName(calculation)
+	}
+
+	for alias, name := range config.Aliases {
+		if slices.Contains(names, alias) {
+			return evaluation{}, fmt.Errorf("alias %s clashes with a calculation of the query", alias)
+		}
+		if !slices.Contains(names, name) {
+			return evaluation{}, fmt.Errorf("alias %s refers to unknown calculation %s", alias, name)
+		}
+	}
+
+	groups, values, hasNull, err := extractGroups(config, names, result)
+	if err != nil {
+		return evaluation{}, err
+	}
+
+	e := evaluation{
+		value: formatValues(values),
+	}
+
+	if config.Freshness != nil {
+		message, err := config.Freshness.check(result, time.Now())
+		if err != nil {
+			return evaluation{}, err
+		}
+		if message != "" {
+			e.phase = config.Freshness.stalePhase()
+			e.message = message
+			return e, nil
+		}
+	}
+
+	if config.MinSamples > 0 {
+		events, err := countEvents(result)
+		if err != nil {
+			return evaluation{}, err
+		}
+		if events < float64(config.MinSamples) {
+			e.phase = v1alpha1.AnalysisPhaseInconclusive
+			e.message = fmt.Sprintf("only %s events, fewer than the %d required by minSamples", formatCalculationValue(events), config.MinSamples)
+			return e, nil
+		}
+	}
+
+	if baselineResult, ok := results[roleBaseline]; ok {
+		// the baseline query is the canary query with another filter, so its calculations are the same
+		baselineResult, _ = splitTimeOffset(baselineResult)
+		if config.MinSamples > 0 {
+			events, err := countEvents(baselineResult)
+			if err != nil {
+				return evaluation{}, err
+			}
+			if events < float64(config.MinSamples) {
+				e.phase = v1alpha1.AnalysisPhaseInconclusive
+				e.message = fmt.Sprintf("only %s baseline events, fewer than the %d required by minSamples", formatCalculationValue(events), config.MinSamples)
+				return e, nil
+			}
+		}
+		baselineGroups, baselineValues, baselineHasNull, err := extractGroups(config, names, baselineResult)
+		if err != nil {
+			return evaluation{}, err
+		}
+
+		var missingBaseline bool
+		groups, missingBaseline = compareGroups(config, groups, baselineGroups)
+		hasNull = hasNull || baselineHasNull || missingBaseline
+		e.metadata = map[string]string{
+			HoneycombCanaryValue:   e.value,
+			HoneycombBaselineValue: formatValues(baselineValues),
+		}
+	}
+
+	if previousResult != nil {
+		previousGroups, previousValues, previousHasNull, err := extractGroups(config, names, previousResult)
+		if err != nil {
+			return evaluation{}, err
+		}
+
+		var missingPrevious bool
+		groups, missingPrevious = matchPrevious(config, groups, previousGroups)
+		hasNull = hasNull || previousHasNull || missingPrevious
+		if e.metadata == nil {
+			e.metadata = make(map[string]string)
+		}
+		e.metadata[HoneycombPreviousValue] = formatValues(previousValues)
+	}
+
+	if hasNull && config.NullValues == NullValuesInconclusive {
+		e.phase = v1alpha1.AnalysisPhaseInconclusive
+		return e, nil
+	}
+
+	if len(groups) == 0 {
+		// every result was skipped
+		e.phase = v1alpha1.AnalysisPhaseInconclusive
+		return e, nil
+	}
+
+	if metric.SuccessCondition == "" && metric.FailureCondition == "" {
+		//Always return success unless there is an error
+		e.phase = v1alpha1.AnalysisPhaseSuccessful
+		return e, nil
+	}
+
+	// evaluate every group against success/failure criteria
+	c, err := compileConditions(metric)
+	if err != nil {
+		return e, err
+	}
+
+	phases := make([]v1alpha1.AnalysisPhase, len(groups))
+	var failedGroups []string
+	for i, g := range groups {
+		phases[i], err = c.evaluate(g.env)
+		if err != nil {
+			return e, err
+		}
+		if phases[i] == v1alpha1.AnalysisPhaseFailed && g.label != "" {
+			failedGroups = append(failedGroups, g.label)
+		}
+	}
+
+	e.phase = aggregatePhases(config.GroupPolicy, phases)
+	if len(failedGroups) > 0 {
+		e.message = fmt.Sprintf("%d of %d groups failed: %s", len(failedGroups), len(groups), strings.Join(failedGroups, "; "))
+	}
+
+	return e, nil
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+const (
+	// OnStaleInconclusive makes measurements of stale data Inconclusive
+	OnStaleInconclusive = "inconclusive"
+	// OnStaleFailed makes measurements of stale data Failed
+	OnStaleFailed = "failed"
+)
+
+// Freshness checks that the query result has recent events, so that a service which stopped sending events does not
+// pass gates on the events it no longer sends
+type Freshness struct {
+	// MaxAge is how old the latest events can be, e.g. 5m
+	MaxAge string `json:"maxAge" protobuf:"bytes,1,opt,name=maxAge"`
+	// OnStale is the phase of measurements of stale data, inconclusive by default
+	OnStale string `json:"onStale,omitempty" protobuf:"bytes,2,opt,name=onStale"`
+}
+
+func (f *Freshness) validate() error {
+	maxAge, err := time.ParseDuration(f.MaxAge)
+	if err != nil {
+		return fmt.Errorf("maxAge is invalid: %w", err)
+	}
+	if maxAge <= 0 {
+		return errors.New("maxAge must be positive")
+	}
+	switch f.OnStale {
+	case "", OnStaleInconclusive, OnStaleFailed:
+	default:
+		return fmt.Errorf("onStale must be one of %s or %s", OnStaleInconclusive, OnStaleFailed)
+	}
+	return nil
+}
+
+func (f *Freshness) stalePhase() v1alpha1.AnalysisPhase {
+	if f.OnStale == OnStaleFailed {
+		return v1alpha1.AnalysisPhaseFailed
+	}
+	return v1alpha1.AnalysisPhaseInconclusive
+}
+
+// check returns why the query result is stale, if it is. The latest events are those of the most recent bucket of
+// the series with a positive COUNT, which withCount adds to queries.
+func (f *Freshness) check(result *QueryResult, now time.Time) (string, error) {
+	// validated by parseConfig
+	maxAge, _ := time.ParseDuration(f.MaxAge)
+
+	var latest time.Time
+	for _, datum := range result.Data.Series {
+		data, ok := datum.Data.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("unexpected series data %v of type %T", datum.Data, datum.Data)
+		}
+		count, _, err := calculationValue(data[countOp])
+		if err != nil {
+			return "", err
+		}
+		if count <= 0 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, datum.Time)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse series time %q: %w", datum.Time, err)
+		}
+		// events may be anywhere in the bucket, up to its end
+		t = t.Add(time.Duration(result.Query.Granularity) * time.Second)
+		if t.After(latest) {
+			latest = t
+		}
+	}
+
+	if latest.IsZero() {
+		return "no events in the query result", nil
+	}
+	if age := now.Sub(latest); age > maxAge {
+		return fmt.Sprintf("latest events are %s old, older than the maxAge of %s", age.Truncate(time.Second), f.MaxAge), nil
+	}
+	return "", nil
+}
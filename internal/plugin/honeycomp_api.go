@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,44 +19,55 @@ const (
 	HoneycombSecret = "honeycomb"
 	HoneycombAPIKey = "api-key"
 	HoneycombURL    = "https://api.honeycomb.io"
+	// APIURLEnvVar is the environment variable overriding the plugin-wide default base URL of the honeycomb API
+	APIURLEnvVar = "HONEYCOMB_API_URL"
 )
 
 type Calculation struct {
 	Op     string  `json:"op"`
-	Column *string `json:"column"`
+	Column *string `json:"column,omitempty"`
+}
+
+// CalculatedField is a derived column defined inline in a query, usable in its calculations, filters and orders
+type CalculatedField struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
 }
 
 type Filter struct {
 	Op     string      `json:"op"`
-	Column *string     `json:"column"`
-	Value  interface{} `json:"value"`
+	Column *string     `json:"column,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
 }
 
 type Order struct {
-	Column string `json:"column"`
-	Op     string `json:"op"`
-	Order  string `json:"order"`
+	Column string `json:"column,omitempty"`
+	Op     string `json:"op,omitempty"`
+	Order  string `json:"order,omitempty"`
 }
 
 type Having struct {
 	CalculateOp string  `json:"calculate_op"`
-	Column      *string `json:"column"`
+	Column      *string `json:"column,omitempty"`
 	Op          string  `json:"op"`
 	Value       float64 `json:"value"`
 }
 
 type Query struct {
-	ID           string        `json:"id"`
-	Breakdowns   []string      `json:"breakdowns"`
-	Calculations []Calculation `json:"calculations"`
-	Filters      []Filter      `json:"filters"`
-	FilterCombo  string        `json:"filter_combination"`
-	Granularity  int           `json:"granularity"`
-	Orders       []Order       `json:"orders"`
-	Limit        int           `json:"limit"`
-	EndTime      int           `json:"end_time"`
-	TimeRange    int           `json:"time_range"`
-	Havings      []Having      `json:"havings"`
+	ID                       string            `json:"id,omitempty"`
+	Breakdowns               []string          `json:"breakdowns,omitempty"`
+	Calculations             []Calculation     `json:"calculations"`
+	Filters                  []Filter          `json:"filters,omitempty"`
+	FilterCombo              string            `json:"filter_combination,omitempty"`
+	Granularity              int               `json:"granularity,omitempty"`
+	Orders                   []Order           `json:"orders,omitempty"`
+	Limit                    int               `json:"limit,omitempty"`
+	StartTime                int               `json:"start_time,omitempty"`
+	EndTime                  int               `json:"end_time,omitempty"`
+	TimeRange                int               `json:"time_range,omitempty"`
+	Havings                  []Having          `json:"havings,omitempty"`
+	CompareTimeOffsetSeconds int               `json:"compare_time_offset_seconds,omitempty"`
+	CalculatedFields         []CalculatedField `json:"calculated_fields,omitempty"`
 }
 
 type SeriesDatum struct {
@@ -82,32 +95,111 @@ type QueryResult struct {
 	} `json:"links"`
 }
 
+// QueryAnnotation names a saved query
+type QueryAnnotation struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	QueryID     string `json:"query_id"`
+}
+
+// SLO is a honeycomb SLO. Compliance and BudgetRemaining are percentages, only returned for detailed requests.
+type SLO struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	TimePeriodDays   int     `json:"time_period_days"`
+	TargetPerMillion int     `json:"target_per_million"`
+	Compliance       float64 `json:"compliance"`
+	BudgetRemaining  float64 `json:"budget_remaining"`
+}
+
+// SLOHistory is the compliance and budget remaining of an SLO at a point in time
+type SLOHistory struct {
+	Timestamp       int64   `json:"timestamp"`
+	Compliance      float64 `json:"compliance"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+}
+
+// Trigger is a honeycomb trigger. Triggered is whether the query of the trigger exceeded its threshold when it last ran.
+type Trigger struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Disabled  bool             `json:"disabled"`
+	Triggered bool             `json:"triggered"`
+	Threshold TriggerThreshold `json:"threshold"`
+}
+
+type TriggerThreshold struct {
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// Marker marks a point or a period in time on the graphs of a dataset. Times are unix seconds.
+type Marker struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Message   string `json:"message,omitempty"`
+	StartTime int64  `json:"start_time,omitempty"`
+	EndTime   int64  `json:"end_time,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
 // HoneycombAPI is the interface to query Honeycomb
 type honeycombAPI interface {
 	CreateQuery(ctx context.Context, query string, dataset string) (*Query, error)
-	GetQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error)
+	// GetQuery returns the specification of an existing query
+	GetQuery(ctx context.Context, queryID string, dataset string) (*Query, error)
+	// ListQueryAnnotations returns the query annotations of the dataset
+	ListQueryAnnotations(ctx context.Context, dataset string) ([]QueryAnnotation, error)
+	// CreateQueryResult starts running the query. The query result is complete once the query has run.
+	CreateQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error)
+	// GetQueryResult polls a query result started by CreateQueryResult
+	GetQueryResult(ctx context.Context, queryResultID string, dataset string) (*QueryResult, error)
+	// GetSLO returns the SLO with its current compliance and budget remaining
+	GetSLO(ctx context.Context, sloID string, dataset string) (*SLO, error)
+	// GetSLOHistory returns the compliance and budget remaining of the SLO between start and end
+	GetSLOHistory(ctx context.Context, sloID string, start time.Time, end time.Time) ([]SLOHistory, error)
+	// GetTrigger returns the trigger with its current state
+	GetTrigger(ctx context.Context, triggerID string, dataset string) (*Trigger, error)
+	CreateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error)
+	// UpdateMarker replaces the marker with the ID of the given marker
+	UpdateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error)
 }
 
 type honeycombClient struct {
-	apiKey string
-	client *http.Client
+	apiKey  string
+	baseURL string
+	client  *http.Client
 }
 
 var _ honeycombAPI = &honeycombClient{}
 
-func newHoneycombAPI(logCtx log.Entry, apiKey string) (honeycombAPI, error) {
+// newHTTPClient returns the http client shared by every honeycombClient created by the plugin. Requests failing
+// with a network error, a 429 or a 5xx response are retried, unless they are not idempotent.
+func newHTTPClient() *http.Client {
 	tr := &http.Transport{
 		MaxIdleConns:       10,
 		IdleConnTimeout:    30 * time.Second,
 		DisableCompression: true,
 	}
-	client := &http.Client{
-		Transport: tr,
+	return &http.Client{
+		Transport: newRetryTransport(tr),
+	}
+}
+
+func newHoneycombAPI(logCtx log.Entry, client *http.Client, apiKey string, baseURL string) (honeycombAPI, error) {
+	if apiKey == "" {
+		return nil, errors.New("honeycomb API key cannot be empty")
+	}
+
+	if baseURL == "" {
+		baseURL = HoneycombURL
 	}
 
 	return &honeycombClient{
-		apiKey: apiKey,
-		client: client,
+		apiKey:  apiKey,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
 	}, nil
 }
 
@@ -115,15 +207,17 @@ type errorResponse struct {
 	Error string `json:"error"`
 }
 
-func (c *honeycombClient) CreateQuery(ctx context.Context, query string, dataset string) (*Query, error) {
-	if dataset == "" {
-		dataset = "__all__"
+// do sends a request to the honeycomb API and decodes the JSON response body into out. Numbers are decoded as
+// json.Number so calculation results keep their precision.
+func (c *honeycombClient) do(ctx context.Context, method string, path string, body []byte, out interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
 	}
 
-	requestBody := bytes.NewBuffer([]byte(query))
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, HoneycombURL+"/1/queries/"+dataset, requestBody)
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bodyReader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Add("Content-Type", "application/json")
@@ -131,29 +225,74 @@ func (c *honeycombClient) CreateQuery(ctx context.Context, query string, dataset
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		var q Query
-		if err := json.Unmarshal(bodyBytes, &q); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(out); err != nil {
+			return fmt.Errorf("failed to unmarshal response body: %w", err)
 		}
-		return &q, nil
+		return nil
 	}
 
+	// error bodies are not always JSON, e.g. when returned by a load balancer
 	var e errorResponse
-	if err := json.Unmarshal(bodyBytes, &e); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
+	if err := json.Unmarshal(bodyBytes, &e); err == nil && e.Error != "" {
+		return errors.New(e.Error)
+	}
+
+	return fmt.Errorf("unexpected response %s", resp.Status)
+}
+
+func (c *honeycombClient) CreateQuery(ctx context.Context, query string, dataset string) (*Query, error) {
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var q Query
+	if err := c.do(ctx, http.MethodPost, "/1/queries/"+dataset, []byte(query), &q); err != nil {
+		return nil, fmt.Errorf("failed to create query: %w", err)
 	}
 
-	return nil, fmt.Errorf("failed to create query: %s", e.Error)
+	return &q, nil
+}
+
+func (c *honeycombClient) GetQuery(ctx context.Context, queryID string, dataset string) (*Query, error) {
+	if queryID == "" {
+		return nil, errors.New("query ID cannot be empty")
+	}
+
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var q Query
+	if err := c.do(ctx, http.MethodGet, "/1/queries/"+dataset+"/"+url.PathEscape(queryID), nil, &q); err != nil {
+		return nil, fmt.Errorf("failed to get query: %w", err)
+	}
+
+	return &q, nil
+}
+
+func (c *honeycombClient) ListQueryAnnotations(ctx context.Context, dataset string) ([]QueryAnnotation, error) {
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var annotations []QueryAnnotation
+	if err := c.do(ctx, http.MethodGet, "/1/query_annotations/"+dataset, nil, &annotations); err != nil {
+		return nil, fmt.Errorf("failed to list query annotations: %w", err)
+	}
+
+	return annotations, nil
 }
 
 type createQueryResultRequest struct {
@@ -162,7 +301,7 @@ type createQueryResultRequest struct {
 	Limit         int    `json:"limit"`
 }
 
-func (c *honeycombClient) GetQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error) {
+func (c *honeycombClient) CreateQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error) {
 	if queryID == "" {
 		return nil, errors.New("query ID cannot be empty")
 	}
@@ -171,7 +310,6 @@ func (c *honeycombClient) GetQueryResult(ctx context.Context, queryID string, da
 		dataset = "__all__"
 	}
 
-	// first, create the query result
 	reqPayload := createQueryResultRequest{
 		QueryID:       queryID,
 		DisableSeries: false,
@@ -182,74 +320,133 @@ func (c *honeycombClient) GetQueryResult(ctx context.Context, queryID string, da
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	bodyReader := bytes.NewReader(reqBytes)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, HoneycombURL+"/1/query_results/"+dataset, bodyReader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	var qr QueryResult
+	if err := c.do(ctx, http.MethodPost, "/1/query_results/"+dataset, reqBytes, &qr); err != nil {
+		return nil, fmt.Errorf("failed to create query result: %w", err)
 	}
 
-	req.Header.Add("X-Honeycomb-Team", c.apiKey)
-	req.Header.Add("Content-Type", "application/json")
+	return &qr, nil
+}
 
-	resp, err := c.client.Do(req)
+func (c *honeycombClient) GetQueryResult(ctx context.Context, queryResultID string, dataset string) (*QueryResult, error) {
+	if queryResultID == "" {
+		return nil, errors.New("query result ID cannot be empty")
+	}
+
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var qr QueryResult
+	if err := c.do(ctx, http.MethodGet, "/1/query_results/"+dataset+"/"+queryResultID, nil, &qr); err != nil {
+		return nil, fmt.Errorf("failed to get query result: %w", err)
+	}
+
+	return &qr, nil
+}
+
+func (c *honeycombClient) GetSLO(ctx context.Context, sloID string, dataset string) (*SLO, error) {
+	if sloID == "" {
+		return nil, errors.New("SLO ID cannot be empty")
+	}
+
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var slo SLO
+	if err := c.do(ctx, http.MethodGet, "/1/slos/"+dataset+"/"+url.PathEscape(sloID)+"?detailed=true", nil, &slo); err != nil {
+		return nil, fmt.Errorf("failed to get SLO: %w", err)
+	}
+
+	return &slo, nil
+}
+
+type sloHistoryRequest struct {
+	IDs       []string `json:"ids"`
+	StartTime int64    `json:"start_time"`
+	EndTime   int64    `json:"end_time"`
+}
+
+func (c *honeycombClient) GetSLOHistory(ctx context.Context, sloID string, start time.Time, end time.Time) ([]SLOHistory, error) {
+	if sloID == "" {
+		return nil, errors.New("SLO ID cannot be empty")
+	}
+
+	reqBytes, err := json.Marshal(sloHistoryRequest{
+		IDs:       []string{sloID},
+		StartTime: start.Unix(),
+		EndTime:   end.Unix(),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	// the history of every requested SLO is keyed by its ID
+	var history map[string][]SLOHistory
+	if err := c.do(ctx, http.MethodPost, "/1/reporting/slos/historical", reqBytes, &history); err != nil {
+		return nil, fmt.Errorf("failed to get SLO history: %w", err)
+	}
+
+	return history[sloID], nil
+}
+
+func (c *honeycombClient) GetTrigger(ctx context.Context, triggerID string, dataset string) (*Trigger, error) {
+	if triggerID == "" {
+		return nil, errors.New("trigger ID cannot be empty")
 	}
-	defer resp.Body.Close()
 
-	// now check for the query result
-	location := resp.Header.Get("Location")
-	req, err = http.NewRequestWithContext(ctx, http.MethodGet, HoneycombURL+location, nil)
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	var trigger Trigger
+	if err := c.do(ctx, http.MethodGet, "/1/triggers/"+dataset+"/"+url.PathEscape(triggerID), nil, &trigger); err != nil {
+		return nil, fmt.Errorf("failed to get trigger %s: %w", triggerID, err)
+	}
+
+	return &trigger, nil
+}
+
+func (c *honeycombClient) CreateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error) {
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	reqBytes, err := json.Marshal(marker)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	req.Header.Add("X-Honeycomb-Team", c.apiKey)
-	req.Header.Add("Content-Type", "application/json")
+	// a marker created twice shows twice on every graph, creating it is only retried when rate limited
+	var m Marker
+	if err := c.do(notIdempotent(ctx), http.MethodPost, "/1/markers/"+dataset, reqBytes, &m); err != nil {
+		return nil, fmt.Errorf("failed to create marker: %w", err)
+	}
 
-	var qr QueryResult
+	return &m, nil
+}
 
-	ticker := time.NewTicker(1 * time.Second)
-	timer := time.NewTimer(10 * time.Second)
-	defer ticker.Stop()
-	defer timer.Stop()
-
-	// query results cannot take longer than 10 seconds to run
-	// ref: https://docs.honeycomb.io/api/tag/Query-Data
-loop:
-	for {
-		select {
-		case <-timer.C:
-			return nil, errors.New("timed out waiting for query result")
-
-		case <-ticker.C:
-			resp, err := c.client.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("failed to execute request: %w", err)
-			}
-			defer resp.Body.Close()
-
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read response body: %w", err)
-			}
-
-			if resp.StatusCode == http.StatusOK {
-				if err := json.Unmarshal(bodyBytes, &qr); err != nil {
-					return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
-				}
-
-				if qr.Complete {
-					break loop
-				}
-			}
-
-			var e errorResponse
-			if err := json.Unmarshal(bodyBytes, &e); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
-			}
-		}
+func (c *honeycombClient) UpdateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error) {
+	if marker.ID == "" {
+		return nil, errors.New("marker ID cannot be empty")
 	}
 
-	return &qr, nil
+	if dataset == "" {
+		dataset = "__all__"
+	}
+
+	id := marker.ID
+	marker.ID = ""
+	reqBytes, err := json.Marshal(marker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	var m Marker
+	if err := c.do(ctx, http.MethodPut, "/1/markers/"+dataset+"/"+url.PathEscape(id), reqBytes, &m); err != nil {
+		return nil, fmt.Errorf("failed to update marker: %w", err)
+	}
+
+	return &m, nil
 }
@@ -0,0 +1,236 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeHoneycomb returns a server standing in for the honeycomb API. The query result is complete after it has
+// been polled once.
+func newFakeHoneycomb(t *testing.T) *httptest.Server {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /1/queries/test", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Honeycomb-Team"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if string(body) != `{"calculations":[{"op":"AVG","column":"duration_ms"}]}` {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid query"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"q1","calculations":[{"op":"AVG","column":"duration_ms"}]}`))
+	})
+	mux.HandleFunc("POST /1/query_results/test", func(w http.ResponseWriter, r *http.Request) {
+		var req createQueryResultRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "q1", req.QueryID)
+		w.Header().Set("Location", "/1/query_results/test/r1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":"r1","complete":false}`))
+	})
+	mux.HandleFunc("GET /1/query_results/test/r1", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls == 1 {
+			_, _ = w.Write([]byte(`{"id":"r1","complete":false}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{
+			"id": "r1",
+			"complete": true,
+			"query": {"calculations": [{"op": "AVG", "column": "duration_ms"}]},
+			"data": {"results": [{"data": {"AVG(duration_ms)": 123.456}}]},
+			"links": {
+				"query_url": "https://ui.honeycomb.io/team/datasets/test/result/r1",
+				"graph_image_url": "https://ui.honeycomb.io/team/datasets/test/result/r1/snapshot"
+			}
+		}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func newFakeHoneycombProvider() *HoneycombProvider {
+	p := NewHoneycombProvider(*log.WithFields(log.Fields{"plugin": "honeycomb"}))
+	client := newHTTPClient()
+	p.newAPI = func(apiKey string, baseURL string) (honeycombAPI, error) {
+		return newHoneycombAPI(p.LogCtx, client, apiKey, baseURL)
+	}
+	return p
+}
+
+func TestRunAgainstFakeHoneycomb(t *testing.T) {
+	server := newFakeHoneycomb(t)
+	defer server.Close()
+
+	config, err := json.Marshal(Config{
+		Query:   `{"calculations":[{"op":"AVG","column":"duration_ms"}]}`,
+		Dataset: "test",
+		APIKey:  "secret",
+		APIURL:  server.URL,
+	})
+	assert.NoError(t, err)
+
+	metric := v1alpha1.Metric{
+		Name:             "latency",
+		SuccessCondition: "result < 200",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: config},
+		},
+	}
+	p := newFakeHoneycombProvider()
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, "q1", measurement.Metadata[HoneycombQueryID])
+	assert.Equal(t, "r1", measurement.Metadata[HoneycombQueryResultID])
+	assert.NotContains(t, measurement.Metadata, HoneycombQueryURL)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, "[123.456]", measurement.Value)
+	assert.Equal(t, map[string]string{
+		HoneycombQueryID:       "q1",
+		HoneycombQueryResultID: "r1",
+		HoneycombQueryURL:      "https://ui.honeycomb.io/team/datasets/test/result/r1",
+		HoneycombGraphImageURL: "https://ui.honeycomb.io/team/datasets/test/result/r1/snapshot",
+	}, measurement.Metadata)
+}
+
+func TestRunAgainstFakeHoneycombWithInvalidQuery(t *testing.T) {
+	server := newFakeHoneycomb(t)
+	defer server.Close()
+
+	p := newFakeHoneycombProvider()
+	p.DefaultAPIURL = server.URL
+
+	measurement := p.Run(newAnalysisRun(), newHoneycombMetric("latency", `{"calculations":[{"op":"AVG"}]}`))
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "failed to create query: invalid query", measurement.Message)
+}
+
+func TestCreateQueryWithNonJSONError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<html><body>Forbidden</body></html>`))
+	}))
+	defer server.Close()
+
+	api, err := newHoneycombAPI(*log.WithFields(log.Fields{}), newHTTPClient(), "secret", server.URL)
+	assert.NoError(t, err)
+
+	_, err = api.CreateQuery(context.Background(), `{}`, "test")
+	assert.EqualError(t, err, "failed to create query: unexpected response 403 Forbidden")
+}
+
+func TestGetSLOAndHistory(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /1/slos/test/slo1", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("detailed"))
+		_, _ = w.Write([]byte(`{"id":"slo1","name":"checkout availability","time_period_days":30,"target_per_million":999000,"compliance":99.95,"budget_remaining":48.5}`))
+	})
+	mux.HandleFunc("POST /1/reporting/slos/historical", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"ids":["slo1"],"start_time":1700000000,"end_time":1700003600}`, string(body))
+		_, _ = w.Write([]byte(`{"slo1":[{"timestamp":1700000000,"compliance":99.96,"budget_remaining":49.1}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api, err := newHoneycombAPI(*log.WithFields(log.Fields{}), newHTTPClient(), "secret", server.URL)
+	assert.NoError(t, err)
+
+	slo, err := api.GetSLO(context.Background(), "slo1", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, &SLO{ID: "slo1", Name: "checkout availability", TimePeriodDays: 30, TargetPerMillion: 999000, Compliance: 99.95, BudgetRemaining: 48.5}, slo)
+
+	history, err := api.GetSLOHistory(context.Background(), "slo1", time.Unix(1700000000, 0), time.Unix(1700003600, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, []SLOHistory{{Timestamp: 1700000000, Compliance: 99.96, BudgetRemaining: 49.1}}, history)
+
+	_, err = api.GetSLO(context.Background(), "slo2", "test")
+	assert.EqualError(t, err, "failed to get SLO: unexpected response 404 Not Found")
+}
+
+func TestGetTrigger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/1/triggers/__all__/t1", r.URL.Path)
+		_, _ = w.Write([]byte(`{"id":"t1","name":"High error rate","disabled":false,"triggered":true,"frequency":300,"threshold":{"op":">","value":0.05,"exceeded_limit":1}}`))
+	}))
+	defer server.Close()
+
+	api, err := newHoneycombAPI(*log.WithFields(log.Fields{}), newHTTPClient(), "secret", server.URL)
+	assert.NoError(t, err)
+
+	trigger, err := api.GetTrigger(context.Background(), "t1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &Trigger{ID: "t1", Name: "High error rate", Triggered: true, Threshold: TriggerThreshold{Op: ">", Value: 0.05}}, trigger)
+}
+
+func TestCreateAndUpdateMarker(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /1/markers/test", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"type":"deploy","message":"guestbook revision 3 started","start_time":1700000000}`, string(body))
+		_, _ = w.Write([]byte(`{"id":"m1","type":"deploy","message":"guestbook revision 3 started","start_time":1700000000}`))
+	})
+	mux.HandleFunc("PUT /1/markers/test/m1", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"type":"deploy","message":"guestbook revision 3 successful","start_time":1700000000,"end_time":1700000600}`, string(body))
+		_, _ = w.Write([]byte(`{"id":"m1","type":"deploy","message":"guestbook revision 3 successful","start_time":1700000000,"end_time":1700000600}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api, err := newHoneycombAPI(*log.WithFields(log.Fields{}), newHTTPClient(), "secret", server.URL)
+	assert.NoError(t, err)
+
+	marker, err := api.CreateMarker(context.Background(), Marker{Type: "deploy", Message: "guestbook revision 3 started", StartTime: 1700000000}, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "m1", marker.ID)
+
+	marker.Message = "guestbook revision 3 successful"
+	marker.EndTime = 1700000600
+	marker, err = api.UpdateMarker(context.Background(), *marker, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000600), marker.EndTime)
+}
+
+func TestGetQueryAndListQueryAnnotations(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /1/queries/test/q1", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id":"q1","calculations":[{"op":"AVG","column":"duration_ms"}],"time_range":600}`))
+	})
+	mux.HandleFunc("GET /1/query_annotations/test", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":"a1","name":"checkout latency","description":"p99 of checkout","query_id":"q1"}]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api, err := newHoneycombAPI(*log.WithFields(log.Fields{}), newHTTPClient(), "secret", server.URL)
+	assert.NoError(t, err)
+
+	query, err := api.GetQuery(context.Background(), "q1", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, &Query{ID: "q1", Calculations: []Calculation{{Op: "AVG", Column: stringPtr("duration_ms")}}, TimeRange: 600}, query)
+
+	annotations, err := api.ListQueryAnnotations(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []QueryAnnotation{{ID: "a1", Name: "checkout latency", Description: "p99 of checkout", QueryID: "q1"}}, annotations)
+}
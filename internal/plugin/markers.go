@@ -0,0 +1,402 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	"github.com/argoproj/argo-rollouts/utils/defaults"
+)
+
+// HoneycombMarkerID is the measurement metadata key of the deploy marker of the AnalysisRun
+const HoneycombMarkerID = "HoneycombMarkerID"
+
+const (
+	// markerType is the type of the markers created for AnalysisRuns
+	markerType = "deploy"
+	// revisionAnnotation is the annotation of the revision of the Rollout an AnalysisRun was started for, the same as
+	// annotations.RevisionAnnotation, whose package pulls in dependencies the plugin does not need
+	revisionAnnotation = "rollout.argoproj.io/revision"
+)
+
+// Markers creates a honeycomb marker when the first measurement of an AnalysisRun runs, which is closed with the
+// verdict of the AnalysisRun once every metric has a final verdict or the AnalysisRun is terminated
+type Markers struct {
+	// Dataset is the dataset the markers are created in. Defaults to the dataset of the metric, use __all__ for
+	// environment-wide markers.
+	Dataset string `json:"dataset,omitempty" protobuf:"bytes,1,opt,name=dataset"`
+}
+
+// dataset returns the dataset of the markers, with the dataset of the metric as default
+func (m *Markers) dataset(config *Config) string {
+	if m.Dataset != "" {
+		return m.Dataset
+	}
+	return config.Dataset
+}
+
+// closedMarkerRetention is how long a closed marker is remembered, so that the other metrics of an AnalysisRun which
+// is terminated do not close it again
+const closedMarkerRetention = 5 * time.Minute
+
+// verdictOrder lists the final phases of metrics from best to worst, like the AnalysisRun controller orders them
+var verdictOrder = []v1alpha1.AnalysisPhase{
+	v1alpha1.AnalysisPhaseSuccessful,
+	v1alpha1.AnalysisPhaseInconclusive,
+	v1alpha1.AnalysisPhaseError,
+	v1alpha1.AnalysisPhaseFailed,
+}
+
+// markerState is a marker created for an AnalysisRun
+type markerState struct {
+	// creating is held while the marker is created, so that concurrent measurements of the AnalysisRun share it
+	creating sync.Mutex
+
+	// the fields below are guarded by the registry
+	id string
+	// config is the config of the metric which created the marker, which closes it from any metric
+	config *Config
+	// verdicts are the final verdicts of the metrics of the AnalysisRun measured since the marker was registered
+	verdicts map[string]v1alpha1.AnalysisPhase
+	closedAt time.Time
+}
+
+// markerRegistry keeps track of the marker of every AnalysisRun, so that every metric and measurement of an
+// AnalysisRun shares a single marker, which is closed once every metric of the AnalysisRun has a final verdict
+type markerRegistry struct {
+	mu      sync.Mutex
+	markers map[types.UID]*markerState
+}
+
+func newMarkerRegistry() *markerRegistry {
+	return &markerRegistry{
+		markers: make(map[types.UID]*markerState),
+	}
+}
+
+// ensure returns the ID of the marker of the AnalysisRun, calling create when it has none. Only the AnalysisRun is
+// locked while the marker is created, so that its concurrent measurements do not create a marker each.
+func (r *markerRegistry) ensure(runUID types.UID, config *Config, create func() (string, error)) (string, error) {
+	r.mu.Lock()
+	now := time.Now()
+	for uid, state := range r.markers {
+		if !state.closedAt.IsZero() && now.Sub(state.closedAt) > closedMarkerRetention {
+			delete(r.markers, uid)
+		}
+	}
+	state, ok := r.markers[runUID]
+	if !ok {
+		state = &markerState{verdicts: make(map[string]v1alpha1.AnalysisPhase)}
+		r.markers[runUID] = state
+	}
+	r.mu.Unlock()
+
+	state.creating.Lock()
+	defer state.creating.Unlock()
+
+	r.mu.Lock()
+	id := state.id
+	r.mu.Unlock()
+	if id != "" {
+		return id, nil
+	}
+
+	id, err := create()
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state.id = id
+	state.config = config
+	return id, nil
+}
+
+// conclude records the final verdict of the metric, if any, and returns the marker of the AnalysisRun and its status
+// once it is to be closed: when every metric of the AnalysisRun has a final verdict, or when the AnalysisRun is
+// terminated. The marker is only returned once.
+func (r *markerRegistry) conclude(run *v1alpha1.AnalysisRun, metric string, verdict v1alpha1.AnalysisPhase, terminated bool) (id string, config *Config, status string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, found := r.markers[run.UID]
+	if !found || state.id == "" || !state.closedAt.IsZero() {
+		return "", nil, "", false
+	}
+	if verdict != "" {
+		state.verdicts[metric] = verdict
+	}
+
+	worst, final := runVerdict(run, state.verdicts)
+	switch {
+	case terminated && (worst == "" || worst == v1alpha1.AnalysisPhaseSuccessful):
+		status = "terminated"
+	case terminated || final:
+		status = strings.ToLower(string(worst))
+	default:
+		return "", nil, "", false
+	}
+	state.closedAt = time.Now()
+	return state.id, state.config, status, true
+}
+
+// forget removes the marker of the AnalysisRun
+func (r *markerRegistry) forget(runUID types.UID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.markers, runUID)
+}
+
+// runVerdict returns the worst verdict of the metrics of the AnalysisRun, and whether every metric measured by the
+// plugin has one. Verdicts are taken from the status of the AnalysisRun for the metrics which completed before they
+// were recorded, e.g. before the plugin restarted, and for the metrics of other providers, which the plugin does not
+// wait for since it is not called when they complete. Dry-run metrics do not count towards the verdict.
+func runVerdict(run *v1alpha1.AnalysisRun, verdicts map[string]v1alpha1.AnalysisPhase) (v1alpha1.AnalysisPhase, bool) {
+	var worst v1alpha1.AnalysisPhase
+	record := func(result *v1alpha1.MetricResult, verdict v1alpha1.AnalysisPhase) {
+		if result != nil && result.DryRun {
+			return
+		}
+		if slices.Index(verdictOrder, verdict) > slices.Index(verdictOrder, worst) {
+			worst = verdict
+		}
+	}
+
+	final := true
+	for _, metric := range run.Spec.Metrics {
+		var result *v1alpha1.MetricResult
+		for i := range run.Status.MetricResults {
+			if run.Status.MetricResults[i].Name == metric.Name {
+				result = &run.Status.MetricResults[i]
+			}
+		}
+
+		if verdict, ok := verdicts[metric.Name]; ok {
+			record(result, verdict)
+		} else if result != nil && result.Phase.Completed() {
+			record(result, result.Phase)
+		} else if _, ok := metric.Provider.Plugin[PluginName]; ok {
+			final = false
+		}
+	}
+	// metrics missing from the spec of the AnalysisRun are only known by their verdicts
+	for metric, verdict := range verdicts {
+		if !slices.ContainsFunc(run.Spec.Metrics, func(m v1alpha1.Metric) bool { return m.Name == metric }) {
+			record(nil, verdict)
+		}
+	}
+
+	if worst == "" {
+		worst = v1alpha1.AnalysisPhaseSuccessful
+	}
+	return worst, final
+}
+
+// imageStore looks up the images deployed by the pods of a rollout revision
+type imageStore interface {
+	Images(ctx context.Context, namespace string, podTemplateHash string) ([]string, error)
+}
+
+// replicaSetImageStore reads the images from the ReplicaSet of the revision
+type replicaSetImageStore struct {
+	clientset kubernetes.Interface
+}
+
+var _ imageStore = &replicaSetImageStore{}
+
+func (s *replicaSetImageStore) Images(ctx context.Context, namespace string, podTemplateHash string) ([]string, error) {
+	selector := labels.Set{v1alpha1.DefaultRolloutUniqueLabelKey: podTemplateHash}.String()
+	replicaSets, err := s.clientset.AppsV1().ReplicaSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replica sets: %w", err)
+	}
+
+	var images []string
+	for _, rs := range replicaSets.Items {
+		for _, container := range rs.Spec.Template.Spec.Containers {
+			if !slices.Contains(images, container.Image) {
+				images = append(images, container.Image)
+			}
+		}
+	}
+	return images, nil
+}
+
+// recordedMarkerID returns the marker recorded in the measurements of the AnalysisRun, if any, so that a restarted
+// plugin does not create another marker for the AnalysisRun
+func recordedMarkerID(run *v1alpha1.AnalysisRun) string {
+	for _, result := range run.Status.MetricResults {
+		for _, measurement := range result.Measurements {
+			if id := measurement.Metadata[HoneycombMarkerID]; id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// finalVerdict returns the phase of the metric when the measurement is its last one, the same way the AnalysisRun
+// controller assesses metrics
+func finalVerdict(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) (v1alpha1.AnalysisPhase, bool) {
+	if measurement.FinishedAt == nil || measurement.Phase == v1alpha1.AnalysisPhaseRunning {
+		return "", false
+	}
+
+	// the measurement is not counted in the metric result yet. Measurements which errored are retried, they do not
+	// count towards the count of the metric.
+	var result v1alpha1.MetricResult
+	for _, r := range run.Status.MetricResults {
+		if r.Name == metric.Name {
+			result = r
+		}
+	}
+	switch measurement.Phase {
+	case v1alpha1.AnalysisPhaseError:
+		result.ConsecutiveError++
+	case v1alpha1.AnalysisPhaseFailed:
+		result.Count++
+		result.Failed++
+		result.ConsecutiveError = 0
+	case v1alpha1.AnalysisPhaseInconclusive:
+		result.Count++
+		result.Inconclusive++
+		result.ConsecutiveError = 0
+	default:
+		result.Count++
+		result.ConsecutiveError = 0
+	}
+
+	if result.ConsecutiveError > defaults.GetConsecutiveErrorLimitOrDefault(&metric) {
+		return v1alpha1.AnalysisPhaseError, true
+	}
+	if metric.InconclusiveLimit == nil && result.Inconclusive > 0 || metric.InconclusiveLimit != nil && result.Inconclusive > int32(metric.InconclusiveLimit.IntValue()) {
+		return v1alpha1.AnalysisPhaseInconclusive, true
+	}
+	if metric.FailureLimit == nil && result.Failed > 0 || metric.FailureLimit != nil && result.Failed > int32(metric.FailureLimit.IntValue()) {
+		return v1alpha1.AnalysisPhaseFailed, true
+	}
+
+	// metrics without a count or an interval are measured once, metrics with an interval but no count indefinitely
+	count := int32(0)
+	if metric.Count != nil {
+		count = int32(metric.Count.IntValue())
+	} else if metric.Interval == "" {
+		count = 1
+	}
+	if count > 0 && result.Count >= count {
+		return v1alpha1.AnalysisPhaseSuccessful, true
+	}
+	return "", false
+}
+
+// newMarker returns the marker of the AnalysisRun, e.g. guestbook revision 3 (nginx:1.25) started
+func (p *HoneycombProvider) newMarker(ctx context.Context, run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, status string) Marker {
+	name := run.Name
+	revision := run.Annotations[revisionAnnotation]
+	qc, err := newQueryContext(run, metric)
+	if err == nil && qc.Rollout != "" {
+		name = qc.Rollout
+	}
+	message := name
+	if revision != "" {
+		message += " revision " + revision
+	}
+	if p.images != nil && err == nil && qc.PodTemplateHash != "" {
+		images, err := p.images.Images(ctx, run.Namespace, qc.PodTemplateHash)
+		if err != nil {
+			p.LogCtx.WithField("metric", metric.Name).Warnf("unable to look up the images of the marker: %v", err)
+		} else if len(images) > 0 {
+			message += " (" + strings.Join(images, ", ") + ")"
+		}
+	}
+
+	startTime := run.CreationTimestamp.Time
+	if startTime.IsZero() {
+		startTime = time.Now()
+	}
+	return Marker{
+		Type:      markerType,
+		Message:   message + " " + status,
+		StartTime: startTime.Unix(),
+	}
+}
+
+// mark creates the marker of the AnalysisRun of the measurement when the metric has markers and the AnalysisRun has
+// none. Once every metric of the AnalysisRun has a final verdict, or the AnalysisRun is terminated, the marker is
+// closed with the worst verdict, or with terminated. Markers are informational: failing to create or update them is
+// logged and does not affect the measurement.
+func (p *HoneycombProvider) mark(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement, terminated bool) v1alpha1.Measurement {
+	if run == nil || run.UID == "" {
+		return measurement
+	}
+	config, err := parseConfig(metric)
+	if err != nil {
+		return measurement
+	}
+	logCtx := p.LogCtx.WithField("metric", metric.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	if config.Markers != nil {
+		id, err := p.markers.ensure(run.UID, config, func() (string, error) {
+			if id := recordedMarkerID(run); id != "" {
+				return id, nil
+			}
+			api, err := p.newConfiguredAPI(ctx, config)
+			if err != nil {
+				return "", err
+			}
+			marker, err := api.CreateMarker(ctx, p.newMarker(ctx, run, metric, "started"), config.Markers.dataset(config))
+			if err != nil {
+				return "", err
+			}
+			return marker.ID, nil
+		})
+		if err != nil {
+			logCtx.Warnf("unable to create honeycomb marker: %v", err)
+			return measurement
+		}
+		if measurement.Metadata == nil {
+			measurement.Metadata = make(map[string]string)
+		}
+		measurement.Metadata[HoneycombMarkerID] = id
+	}
+
+	// metrics without markers take part in the verdict of the marker of the AnalysisRun too
+	var verdict v1alpha1.AnalysisPhase
+	if !terminated {
+		phase, final := finalVerdict(run, metric, measurement)
+		if !final {
+			return measurement
+		}
+		verdict = phase
+	}
+	id, markerConfig, status, ok := p.markers.conclude(run, metric.Name, verdict, terminated)
+	if !ok {
+		return measurement
+	}
+
+	api, err := p.newConfiguredAPI(ctx, markerConfig)
+	if err != nil {
+		logCtx.Warnf("unable to close honeycomb marker %s: %v", id, err)
+		return measurement
+	}
+	marker := p.newMarker(ctx, run, metric, status)
+	marker.ID = id
+	marker.EndTime = time.Now().Unix()
+	if _, err := api.UpdateMarker(ctx, marker, markerConfig.Markers.dataset(markerConfig)); err != nil {
+		logCtx.Warnf("unable to close honeycomb marker %s: %v", id, err)
+	}
+	return measurement
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	// HoneycombPreviousValue is the measurement metadata key of the value of the offset period of a query with a
+	// compare_time_offset_seconds
+	HoneycombPreviousValue = "HoneycombPreviousValue"
+
+	// comparisonMember marks the rows and buckets of a query result which belong to the offset period of a query
+	// with a compare_time_offset_seconds
+	comparisonMember = "is_comparison"
+)
+
+// compareTimeOffsets are the offsets honeycomb supports for compare_time_offset_seconds, from 30 minutes to 26 weeks
+var compareTimeOffsets = []int{1800, 3600, 7200, 28800, 86400, 604800, 2419200, 15724800}
+
+func validateCompareTimeOffset(offset int) error {
+	if offset != 0 && !slices.Contains(compareTimeOffsets, offset) {
+		return fmt.Errorf("compare_time_offset_seconds must be one of %v, got %d", compareTimeOffsets, offset)
+	}
+	return nil
+}
+
+// splitTimeOffset splits the rows and buckets of a query result with a compare_time_offset_seconds into the query
+// result of the current period and the query result of the offset period. previous is nil when the query has no
+// time offset.
+func splitTimeOffset(result *QueryResult) (current *QueryResult, previous *QueryResult) {
+	if result.Query.CompareTimeOffsetSeconds == 0 {
+		return result, nil
+	}
+
+	c := *result
+	c.Data = QueryResultData{}
+	p := *result
+	p.Data = QueryResultData{}
+
+	for _, datum := range result.Data.Results {
+		if isComparison(datum.Data) {
+			p.Data.Results = append(p.Data.Results, datum)
+		} else {
+			c.Data.Results = append(c.Data.Results, datum)
+		}
+	}
+	for _, datum := range result.Data.Series {
+		data, _ := datum.Data.(map[string]interface{})
+		if isComparison(data) {
+			p.Data.Series = append(p.Data.Series, datum)
+		} else {
+			c.Data.Series = append(c.Data.Series, datum)
+		}
+	}
+	return &c, &p
+}
+
+func isComparison(data map[string]interface{}) bool {
+	comparison, _ := data[comparisonMember].(bool)
+	return comparison
+}
+
+// matchPrevious sets the previous values of every group from the group of the offset period with the same breakdown
+// values. A group without a previous group is handled like a null value.
+func matchPrevious(config *Config, current []group, previous []group) (groups []group, hasNull bool) {
+	previousGroups := make(map[string]envStruct, len(previous))
+	for _, g := range previous {
+		previousGroups[g.label] = g.env
+	}
+
+	groups = make([]group, 0, len(current))
+	for _, g := range current {
+		p, ok := previousGroups[g.label]
+		if !ok {
+			hasNull = true
+			if config.NullValues != NullValuesZero {
+				continue
+			}
+		}
+		g.env.Previous = p.Result
+		g.env.PreviousResults = p.Results
+		groups = append(groups, g)
+	}
+	return groups, hasNull
+}
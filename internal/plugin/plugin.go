@@ -2,19 +2,18 @@ package plugin
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
 	"time"
 
-	"github.com/expr-lang/expr"
-	"github.com/expr-lang/expr/vm"
 	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/argoproj/argo-rollouts/metricproviders/plugin"
 	rolloutsPlugin "github.com/argoproj/argo-rollouts/metricproviders/plugin/rpc"
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	"github.com/argoproj/argo-rollouts/utils/defaults"
 	metricutil "github.com/argoproj/argo-rollouts/utils/metric"
 	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
 	timeutil "github.com/argoproj/argo-rollouts/utils/time"
@@ -22,55 +21,81 @@ import (
 
 const (
 	ResolvedHoneycombQuery = "ResolvedHoneycombQuery"
+	// HoneycombQueryID is the measurement metadata key of the query the measurement ran
+	HoneycombQueryID = "HoneycombQueryID"
+	// HoneycombQueryResultID is the measurement metadata key of the query result the measurement waits for
+	HoneycombQueryResultID = "HoneycombQueryResultID"
+	// HoneycombQueryURL is the measurement metadata key of the link to the query result in the honeycomb UI
+	HoneycombQueryURL = "HoneycombQueryURL"
+	// HoneycombGraphImageURL is the measurement metadata key of the link to a graph snapshot of the query result
+	HoneycombGraphImageURL = "HoneycombGraphImageURL"
+	// HoneycombCanaryValue is the measurement metadata key of the value of the canary in comparison mode
+	HoneycombCanaryValue = "HoneycombCanaryValue"
+	// HoneycombBaselineValue is the measurement metadata key of the value of the baseline in comparison mode
+	HoneycombBaselineValue = "HoneycombBaselineValue"
+)
+
+const (
+	// apiTimeout bounds every call the plugin makes to the honeycomb API
+	apiTimeout = 10 * time.Second
+	// queryResultPollInterval is how long a measurement waits before polling an incomplete query result again
+	queryResultPollInterval = 1 * time.Second
+	// queryResultTimeout is how long a measurement waits for its query result before giving up. Query results cannot
+	// take longer than 10 seconds to run, the rest leaves room for the controller to resume the measurement.
+	// ref: https://docs.honeycomb.io/api/tag/Query-Data
+	queryResultTimeout = 1 * time.Minute
 )
 
 // Implements the Provider Interface
 type HoneycombProvider struct {
-	api      honeycombAPI
-	queryID  string
-	rawQuery string
-	dataset  string
-	apiKey   string
-	LogCtx   log.Entry
+	// newAPI creates a honeycomb client for the API at the base URL, authenticated with the API key
+	newAPI func(apiKey string, baseURL string) (honeycombAPI, error)
+	// secrets serves the API keys of metrics which do not set one inline
+	secrets apiKeyStore
+	// queries holds the honeycomb queries created for each metric of each AnalysisRun
+	queries *queryRegistry
+	// markers holds the honeycomb marker created for each AnalysisRun
+	markers *markerRegistry
+	// images looks up the images of the revision a marker is created for, nil when Kubernetes is unavailable
+	images imageStore
+	// DefaultAPIURL is the base URL of the honeycomb API used by metrics which do not set apiURL
+	DefaultAPIURL string
+	LogCtx        log.Entry
 }
 
 var _ rolloutsPlugin.MetricProviderPlugin = (*HoneycombProvider)(nil)
 
-type Config struct {
-	// Query is a raw honeycomb query to perform
-	Query string `json:"query,omitempty" protobuf:"bytes,1,opt,name=query"`
-	// Dataset is the name of the honeycomb dataset to query
-	Dataset string `json:"dataset,omitempty" protobuf:"bytes,2,opt,name=dataset"`
-	// APIKey is the honeycomb API key to use for authentication
-	APIKey string `json:"apiKey,omitempty" protobuf:"bytes,3,opt,name=apiKey"`
+// NewHoneycombProvider returns a provider which resolves its configuration from each metric it is asked to measure,
+// so a single plugin process can serve every AnalysisTemplate in the cluster.
+func NewHoneycombProvider(logCtx log.Entry) *HoneycombProvider {
+	return &HoneycombProvider{
+		queries: newQueryRegistry(),
+		markers: newMarkerRegistry(),
+		LogCtx:  logCtx,
+	}
 }
 
-func NewHoneycombProvider(metric v1alpha1.Metric) (*HoneycombProvider, error) {
-	config := Config{}
-
-	pluginConfig, ok := metric.Provider.Plugin["argoproj-labs/honeycomb"]
-	if !ok {
-		return nil, errors.New("unable to find honeycomb plugin config")
+func (p *HoneycombProvider) InitPlugin() pluginTypes.RpcError {
+	if p.DefaultAPIURL != "" {
+		if err := validateAPIURL(p.DefaultAPIURL); err != nil {
+			return pluginTypes.RpcError{ErrorString: fmt.Sprintf("default honeycomb API URL is invalid: %v", err)}
+		}
 	}
 
-	err := json.Unmarshal(pluginConfig, &config)
-	if err != nil {
-		return nil, err
+	client := newHTTPClient()
+	p.newAPI = func(apiKey string, baseURL string) (honeycombAPI, error) {
+		return newHoneycombAPI(p.LogCtx, client, apiKey, baseURL)
 	}
 
-	return &HoneycombProvider{
-		rawQuery: config.Query,
-		dataset:  config.Dataset,
-		apiKey:   config.APIKey,
-	}, nil
-}
-
-func (p *HoneycombProvider) InitPlugin() pluginTypes.RpcError {
-	api, err := newHoneycombAPI(p.LogCtx, p.apiKey)
+	clientset, err := newKubernetesClientset()
 	if err != nil {
-		return pluginTypes.RpcError{ErrorString: err.Error()}
+		p.LogCtx.Warnf("API keys can only be set inline: %v", err)
+		p.secrets = unavailableSecretStore{err: err}
+	} else {
+		// the secrets are watched for the lifetime of the plugin process
+		p.secrets = newSecretStore(context.Background(), clientset, defaults.Namespace())
+		p.images = &replicaSetImageStore{clientset: clientset}
 	}
-	p.api = api
 
 	return pluginTypes.RpcError{}
 }
@@ -82,172 +107,312 @@ func (p *HoneycombProvider) Type() string {
 // GetMetadata returns any additional metadata which needs to be stored & displayed as part of the metrics result.
 func (p *HoneycombProvider) GetMetadata(metric v1alpha1.Metric) map[string]string {
 	metricsMetadata := make(map[string]string)
-	if p.rawQuery != "" {
-		metricsMetadata[ResolvedHoneycombQuery] = p.rawQuery
+
+	config, err := parseConfig(metric)
+	if err != nil {
+		p.LogCtx.WithField("metric", metric.Name).Warnf("unable to resolve honeycomb query: %v", err)
+		return metricsMetadata
+	}
+
+	if config.SLO != nil {
+		metricsMetadata[HoneycombSLOID] = config.SLO.ID
+		return metricsMetadata
+	}
+	if len(config.Triggers) > 0 {
+		// triggers run their own queries
+		return metricsMetadata
+	}
+	if config.savedQuery() {
+		queryID, spec, err := p.savedQuerySpec(config)
+		if err != nil {
+			p.LogCtx.WithField("metric", metric.Name).Warnf("unable to resolve honeycomb query: %v", err)
+			return metricsMetadata
+		}
+		metricsMetadata[HoneycombQueryID] = queryID
+		metricsMetadata[ResolvedHoneycombQuery] = spec
+		return metricsMetadata
+	}
+
+	// there is no AnalysisRun to render the query with, its templates are reported as is
+	queries, err := config.measurementQueries(nil, nil)
+	if err != nil {
+		p.LogCtx.WithField("metric", metric.Name).Warnf("unable to resolve honeycomb query: %v", err)
+		return metricsMetadata
+	}
+
+	for _, q := range queries {
+		metricsMetadata[roleKey(ResolvedHoneycombQuery, q.role)] = q.text
 	}
 	return metricsMetadata
 }
 
-// Run queries Honeycomb for the metric data
+// Run starts running the honeycomb queries of the metric. The measurement stays Running until every query result
+// is complete, which Resume polls for. Metrics evaluating an SLO or triggers complete right away.
 func (p *HoneycombProvider) Run(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric) v1alpha1.Measurement {
+	return p.release(run, metric, p.mark(run, metric, p.run(run, metric), false))
+}
+
+func (p *HoneycombProvider) run(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric) v1alpha1.Measurement {
 	startTime := timeutil.MetaNow()
 	newMeasurement := v1alpha1.Measurement{
 		StartedAt: &startTime,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	config, err := parseConfig(metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(newMeasurement, err)
+	}
+
+	if config.SLO != nil {
+		return p.runSLO(metric, config, newMeasurement)
+	}
+	if len(config.Triggers) > 0 {
+		return p.runTriggers(config, newMeasurement)
+	}
+	if config.savedQuery() {
+		return p.runSavedQuery(metric, config, newMeasurement)
+	}
 
-	if p.queryID == "" {
-		query, err := p.api.CreateQuery(ctx, p.rawQuery, p.dataset)
+	qc, err := newQueryContext(run, metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(newMeasurement, err)
+	}
+
+	var window *timeWindow
+	if config.Window != nil {
+		tw, err := config.Window.measurementWindow(run, metric.Name, time.Now())
 		if err != nil {
 			return metricutil.MarkMeasurementError(newMeasurement, err)
 		}
-
-		p.queryID = query.ID
+		if tw.empty() {
+			// the window of the previous measurement ended after this one would
+			finishedTime := timeutil.MetaNow()
+			newMeasurement.FinishedAt = &finishedTime
+			newMeasurement.Phase = v1alpha1.AnalysisPhaseInconclusive
+			newMeasurement.Message = fmt.Sprintf("window from %s to %s is empty", tw.start.Format(time.RFC3339), tw.end.Format(time.RFC3339))
+			// the window of the next measurement starts where the previous one ended
+			newMeasurement.Metadata = map[string]string{
+				HoneycombWindowStart: tw.start.Format(time.RFC3339),
+				HoneycombWindowEnd:   tw.start.Format(time.RFC3339),
+			}
+			return newMeasurement
+		}
+		window = &tw
 	}
 
-	queryResult, err := p.api.GetQueryResult(ctx, p.queryID, p.dataset)
+	queries, err := config.measurementQueries(qc, window)
 	if err != nil {
 		return metricutil.MarkMeasurementError(newMeasurement, err)
 	}
 
-	valueStr, newStatus, err := p.processResponse(metric, queryResult)
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	api, err := p.newConfiguredAPI(ctx, config)
 	if err != nil {
 		return metricutil.MarkMeasurementError(newMeasurement, err)
 	}
-	newMeasurement.Value = valueStr
-	newMeasurement.Phase = newStatus
-
-	finishedTime := timeutil.MetaNow()
-	newMeasurement.FinishedAt = &finishedTime
-	return newMeasurement
-}
-
-type envStruct struct {
-	Result int `expr:"result"`
-}
 
-func (p *HoneycombProvider) processResponse(metric v1alpha1.Metric, result *QueryResult) (string, v1alpha1.AnalysisPhase, error) {
-	if len(result.Data.Results) == 0 {
-		return "", v1alpha1.AnalysisPhaseFailed, errors.New("no results returned")
+	newMeasurement.Metadata = make(map[string]string, len(queries))
+	if window != nil {
+		newMeasurement.Metadata[HoneycombWindowStart] = window.start.Format(time.RFC3339)
+		newMeasurement.Metadata[HoneycombWindowEnd] = window.end.Format(time.RFC3339)
 	}
+	results := make(map[string]*QueryResult, len(queries))
+	for _, q := range queries {
+		queryID, err := p.resolveQueryID(ctx, api, run, metric, config, q)
+		if err != nil {
+			return metricutil.MarkMeasurementError(newMeasurement, err)
+		}
 
-	if len(result.Query.Calculations) == 0 {
-		// this shouldn't happen, but just in case
-		return "", v1alpha1.AnalysisPhaseFailed, errors.New("no calculations specifed in query")
+		queryResult, err := api.CreateQueryResult(ctx, queryID, config.Dataset)
+		if err != nil {
+			return metricutil.MarkMeasurementError(newMeasurement, err)
+		}
+		newMeasurement.Metadata[roleKey(HoneycombQueryID, q.role)] = queryID
+		newMeasurement.Metadata[roleKey(HoneycombQueryResultID, q.role)] = queryResult.ID
+		results[q.role] = queryResult
 	}
 
-	var op string
-	if result.Query.Calculations[0].Column != nil {
-		op = fmt.Sprintf("%s(%s)", result.Query.Calculations[0].Op, *result.Query.Calculations[0].Column)
-	} else {
-		op = result.Query.Calculations[0].Op
-	}
+	return p.processQueryResults(metric, config, newMeasurement, results)
+}
+
+// processQueryResults completes the measurement with the evaluation of the query results once they are all
+// complete, otherwise it schedules the measurement to be resumed
+func (p *HoneycombProvider) processQueryResults(metric v1alpha1.Metric, config *Config, measurement v1alpha1.Measurement, results map[string]*QueryResult) v1alpha1.Measurement {
+	for _, queryResult := range results {
+		if queryResult.Complete {
+			continue
+		}
 
-	values := make([]int, len(result.Data.Results))
-	valuesStr := make([]string, len(result.Data.Results))
+		if measurement.StartedAt != nil && time.Since(measurement.StartedAt.Time) > queryResultTimeout {
+			return metricutil.MarkMeasurementError(measurement, errors.New("timed out waiting for query result"))
+		}
 
-	for i, result := range result.Data.Results {
-		resultValue := result.Data[op]
-		values[i] = resultValue.(int)
-		valuesStr[i] = fmt.Sprintf("%d", resultValue)
+		resumeAt := metav1.NewTime(time.Now().Add(queryResultPollInterval))
+		measurement.Phase = v1alpha1.AnalysisPhaseRunning
+		measurement.ResumeAt = &resumeAt
+		return measurement
 	}
 
-	var sb strings.Builder
-	sb.WriteString("[")
-	sb.WriteString(strings.Join(valuesStr, ", "))
-	sb.WriteString("]")
-	valueStr := sb.String()
+	// the links are recorded even when the evaluation fails, to look into the query result
+	for role, queryResult := range results {
+		if queryResult.Links.QueryURL != "" {
+			measurement.Metadata[roleKey(HoneycombQueryURL, role)] = queryResult.Links.QueryURL
+		}
+		if queryResult.Links.GraphImageURL != "" {
+			measurement.Metadata[roleKey(HoneycombGraphImageURL, role)] = queryResult.Links.GraphImageURL
+		}
+	}
 
-	if metric.SuccessCondition == "" && metric.FailureCondition == "" {
-		//Always return success unless there is an error
-		return valueStr, v1alpha1.AnalysisPhaseSuccessful, nil
+	e, err := p.processResponse(metric, config, results)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	measurement.Value = e.value
+	measurement.Phase = e.phase
+	measurement.Message = e.message
+	measurement.ResumeAt = nil
+	for k, v := range e.metadata {
+		measurement.Metadata[k] = v
 	}
 
-	// evaluate results against success/failure criteria
-	var successProgram, failProgram *vm.Program
-	var err error
-	if metric.SuccessCondition != "" {
-		successProgram, err = expr.Compile(metric.SuccessCondition, expr.Env(envStruct{}))
+	finishedTime := timeutil.MetaNow()
+	measurement.FinishedAt = &finishedTime
+	return measurement
+}
+
+// newConfiguredAPI returns a honeycomb client for the API URL of the config, authenticated with the API key of the
+// config, which is either set inline or read from a secret in the argo-rollouts namespace
+func (p *HoneycombProvider) newConfiguredAPI(ctx context.Context, config *Config) (honeycombAPI, error) {
+	apiKey := config.APIKey
+	if apiKey == "" {
+		ref := config.secretKeyRef()
+		var err error
+		apiKey, err = p.secrets.APIKey(ctx, ref.Name, ref.Key)
 		if err != nil {
-			return valueStr, v1alpha1.AnalysisPhaseFailed, err
+			return nil, fmt.Errorf("failed to read honeycomb API key: %w", err)
 		}
 	}
 
-	if metric.FailureCondition != "" {
-		failProgram, err = expr.Compile(metric.FailureCondition, expr.Env(envStruct{}))
-		if err != nil {
-			return valueStr, v1alpha1.AnalysisPhaseFailed, err
-		}
+	baseURL := config.APIURL
+	if baseURL == "" {
+		baseURL = p.DefaultAPIURL
 	}
 
-	// apply threshold to the first operator if there are multiple
-	successCondition := false
-	failCondition := false
+	return p.newAPI(apiKey, baseURL)
+}
 
-	for _, resultValue := range values {
-		env := envStruct{
-			Result: resultValue,
-		}
+// resolveQueryID returns the ID of the honeycomb query for the metric of the AnalysisRun, creating the query when
+// it has not been created yet or when its text has changed since it was created.
+func (p *HoneycombProvider) resolveQueryID(ctx context.Context, api honeycombAPI, run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, config *Config, q measurementQuery) (string, error) {
+	uid := runUID(run)
+	queryHash := hashQuery(q.text, config.Dataset)
+	if queryID, ok := p.queries.get(uid, metric.Name, q.role, queryHash); ok {
+		return queryID, nil
+	}
 
-		if metric.SuccessCondition != "" {
-			output, err := expr.Run(successProgram, env)
-			if err != nil {
-				return valueStr, v1alpha1.AnalysisPhaseError, err
-			}
+	query, err := api.CreateQuery(ctx, q.text, config.Dataset)
+	if err != nil {
+		return "", err
+	}
 
-			switch val := output.(type) {
-			case bool:
-				successCondition = val
-			default:
-				return valueStr, v1alpha1.AnalysisPhaseError, fmt.Errorf("expected bool, but got %T", val)
-			}
-		}
+	p.queries.set(uid, metric.Name, q.role, queryHash, query.ID)
+	return query.ID, nil
+}
 
-		if metric.FailureCondition != "" {
-			output, err := expr.Run(failProgram, env)
-			if err != nil {
-				return valueStr, v1alpha1.AnalysisPhaseError, err
-			}
+// release forgets the honeycomb queries of the metric of the AnalysisRun once the measurement is its final one, as
+// no further measurement reuses them
+func (p *HoneycombProvider) release(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	if run == nil {
+		return measurement
+	}
+	if _, final := finalVerdict(run, metric, measurement); final {
+		p.queries.forget(run.UID, metric.Name)
+	}
+	return measurement
+}
 
-			switch val := output.(type) {
-			case bool:
-				failCondition = val
-			default:
-				return valueStr, v1alpha1.AnalysisPhaseError, fmt.Errorf("expected bool, but got %T", val)
-			}
-		}
+// runUID returns the UID of the AnalysisRun, or an empty UID when there is none
+func runUID(run *v1alpha1.AnalysisRun) types.UID {
+	if run == nil {
+		return ""
 	}
+	return run.UID
+}
+
+// Resume polls the query results of a Running measurement once and completes the measurement when they are complete
+func (p *HoneycombProvider) Resume(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	return p.release(run, metric, p.mark(run, metric, p.resume(run, metric, measurement), false))
+}
 
-	switch {
-	case metric.SuccessCondition != "" && metric.FailureCondition == "":
-		// Without a failure condition, a measurement is considered a failure if the measurement's success condition is not true
-		failCondition = !successCondition
-	case metric.SuccessCondition == "" && metric.FailureCondition != "":
-		// Without a success condition, a measurement is considered a successful if the measurement's failure condition is not true
-		successCondition = !failCondition
+func (p *HoneycombProvider) resume(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	config, err := parseConfig(metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
 	}
 
-	if failCondition {
-		return valueStr, v1alpha1.AnalysisPhaseFailed, nil
+	qc, err := newQueryContext(run, metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
 	}
 
-	if !failCondition && !successCondition {
-		return valueStr, v1alpha1.AnalysisPhaseInconclusive, nil
+	// the queries are only needed for their roles, the query results are already running
+	queries, err := config.measurementQueries(qc, nil)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
 	}
 
-	return valueStr, v1alpha1.AnalysisPhaseSuccessful, nil
-}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
 
-func (p *HoneycombProvider) Resume(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
-	return measurement
+	api, err := p.newConfiguredAPI(ctx, config)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	results := make(map[string]*QueryResult, len(queries))
+	for _, q := range queries {
+		queryResultID := measurement.Metadata[roleKey(HoneycombQueryResultID, q.role)]
+		if queryResultID == "" {
+			return metricutil.MarkMeasurementError(measurement, errors.New("measurement has no honeycomb query result to resume"))
+		}
+
+		queryResult, err := api.GetQueryResult(ctx, queryResultID, config.Dataset)
+		if err != nil {
+			return metricutil.MarkMeasurementError(measurement, err)
+		}
+		results[q.role] = queryResult
+	}
+
+	return p.processQueryResults(metric, config, measurement, results)
 }
 
+// Terminate abandons the query results of a Running measurement. Honeycomb has no way to cancel a query result, they
+// are simply no longer polled. The queries of the metric are released, and the marker of the AnalysisRun, if any, is
+// closed.
 func (p *HoneycombProvider) Terminate(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
-	return measurement
+	if _, err := parseConfig(metric); err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	p.queries.forget(runUID(run), metric.Name)
+
+	finishedTime := timeutil.MetaNow()
+	measurement.FinishedAt = &finishedTime
+	measurement.Phase = v1alpha1.AnalysisPhaseSuccessful
+	measurement.ResumeAt = nil
+	p.LogCtx.WithField("metric", metric.Name).Infof("abandoned query result %s", measurement.Metadata[HoneycombQueryResultID])
+	return p.mark(run, metric, measurement, true)
 }
 
+// GarbageCollect releases the honeycomb queries recorded for the metric of a completed AnalysisRun, and its marker.
+// Argo Rollouts garbage collects metrics with more measurements than it retains on every reconcile, also while the
+// AnalysisRun is running, when the queries are still reused. They are otherwise released by the final measurement of
+// the metric, see release, or when it is terminated.
 func (p *HoneycombProvider) GarbageCollect(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric, i int) pluginTypes.RpcError {
+	if run != nil && run.Status.Phase.Completed() {
+		p.queries.forget(run.UID, metric.Name)
+		p.markers.forget(run.UID)
+	}
 	return pluginTypes.RpcError{}
 }
@@ -4,32 +4,195 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
 	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 type mockAPI struct {
 	response *QueryResult
 	err      error
+	// pendingResults is the number of incomplete query results returned before the response
+	pendingResults int
+	// responseFor returns the response to a query result by the text of its query, instead of response
+	responseFor func(query string) *QueryResult
+
+	apiKey         string
+	baseURL        string
+	query          string
+	dataset        string
+	createdQueries int
+	queryIDs       []string
+	queryResultIDs []string
+	// queryTexts and resultQueries map query IDs to query texts and query result IDs to query IDs
+	queryTexts    map[string]string
+	resultQueries map[string]string
+
+	slo        *SLO
+	sloHistory []SLOHistory
+	// sloHistoryStart is the start of the last SLO history requested
+	sloHistoryStart time.Time
+
+	triggers map[string]*Trigger
+
+	// markers are the markers created, updated in place
+	markers       []Marker
+	markerDataset string
+	markerUpdates int
+
+	savedQueries map[string]*Query
+	annotations  []QueryAnnotation
 }
 
 func (m *mockAPI) CreateQuery(ctx context.Context, query string, dataset string) (*Query, error) {
+	m.query = query
+	m.dataset = dataset
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.createdQueries++
+	id := fmt.Sprintf("query-%d", m.createdQueries)
+	if m.queryTexts == nil {
+		m.queryTexts = make(map[string]string)
+	}
+	m.queryTexts[id] = query
+	return &Query{ID: id}, nil
+}
+
+func (m *mockAPI) GetQuery(ctx context.Context, queryID string, dataset string) (*Query, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	query, ok := m.savedQueries[queryID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get query: query %s not found", queryID)
+	}
+	q := *query
+	q.ID = queryID
+	return &q, nil
+}
+
+func (m *mockAPI) ListQueryAnnotations(ctx context.Context, dataset string) ([]QueryAnnotation, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.annotations, nil
+}
+
+func (m *mockAPI) CreateQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error) {
+	m.queryIDs = append(m.queryIDs, queryID)
+	if m.err != nil {
+		return nil, m.err
+	}
+	id := fmt.Sprintf("result-%d", len(m.queryIDs))
+	if m.resultQueries == nil {
+		m.resultQueries = make(map[string]string)
+	}
+	m.resultQueries[id] = queryID
+	return m.queryResult(id)
+}
+
+func (m *mockAPI) GetQueryResult(ctx context.Context, queryResultID string, dataset string) (*QueryResult, error) {
+	m.queryResultIDs = append(m.queryResultIDs, queryResultID)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.queryResult(queryResultID)
+}
+
+func (m *mockAPI) GetSLO(ctx context.Context, sloID string, dataset string) (*SLO, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	slo := *m.slo
+	slo.ID = sloID
+	return &slo, nil
+}
+
+func (m *mockAPI) GetSLOHistory(ctx context.Context, sloID string, start time.Time, end time.Time) ([]SLOHistory, error) {
+	m.sloHistoryStart = start
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.sloHistory, nil
+}
+
+func (m *mockAPI) GetTrigger(ctx context.Context, triggerID string, dataset string) (*Trigger, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	trigger, ok := m.triggers[triggerID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get trigger %s: trigger not found", triggerID)
+	}
+	return trigger, nil
+}
+
+func (m *mockAPI) CreateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
-	return &Query{}, nil
+	marker.ID = fmt.Sprintf("marker-%d", len(m.markers)+1)
+	m.markers = append(m.markers, marker)
+	m.markerDataset = dataset
+	return &marker, nil
 }
 
-func (m *mockAPI) GetQueryResult(ctx context.Context, queryID string, dataset string) (*QueryResult, error) {
+func (m *mockAPI) UpdateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
-	return m.response, nil
+	m.markerUpdates++
+	for i := range m.markers {
+		if m.markers[i].ID == marker.ID {
+			m.markers[i] = marker
+			return &marker, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update marker: marker %s not found", marker.ID)
+}
+
+func (m *mockAPI) queryResult(id string) (*QueryResult, error) {
+	if m.pendingResults > 0 {
+		m.pendingResults--
+		return &QueryResult{ID: id}, nil
+	}
+	r := m.response
+	if m.responseFor != nil {
+		r = m.responseFor(m.queryTexts[m.resultQueries[id]])
+	}
+	if r == nil {
+		return &QueryResult{ID: id, Complete: true}, nil
+	}
+	response := *r
+	response.ID = id
+	return &response, nil
+}
+
+func newTestProvider(m *mockAPI) *HoneycombProvider {
+	p := NewHoneycombProvider(*log.WithFields(log.Fields{"plugin": "honeycomb"}))
+	p.newAPI = func(apiKey string, baseURL string) (honeycombAPI, error) {
+		m.apiKey = apiKey
+		m.baseURL = baseURL
+		return m, nil
+	}
+	return p
 }
 
 func newAnalysisRun() *v1alpha1.AnalysisRun {
@@ -156,6 +319,7 @@ func TestRunSuccessfully(t *testing.T) {
 	config := Config{
 		Query:   string(b),
 		Dataset: "test",
+		APIKey:  "secret",
 	}
 
 	configBytes, err := json.Marshal(config)
@@ -166,13 +330,10 @@ func TestRunSuccessfully(t *testing.T) {
 		SuccessCondition: "result < 300",
 		FailureCondition: "result > 310",
 		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": configBytes},
+			Plugin: map[string]json.RawMessage{PluginName: configBytes},
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
-
-	p.api = mock
+	p := newTestProvider(mock)
 
 	measurement := p.Run(newAnalysisRun(), metric)
 
@@ -183,191 +344,2757 @@ func TestRunSuccessfully(t *testing.T) {
 
 }
 
-func TestGetMetadata(t *testing.T) {
+func TestRunResolvesConfigFromMetric(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+
 	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result < 300",
-		FailureCondition: "result > 310",
+		Name: "foo",
 		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": []byte(`{"query":"bar","dataset":"test"}`)},
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","dataset":"test","apiKey":"secret"}`)},
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
-
-	p.api = &mockAPI{}
+	p := newTestProvider(mock)
 
-	metadata := p.GetMetadata(metric)
-	assert.Equal(t, "bar", metadata[ResolvedHoneycombQuery])
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, "secret", mock.apiKey)
+	assert.Equal(t, "bar", mock.query)
+	assert.Equal(t, "test", mock.dataset)
 }
 
-func TestRunWithQueryError(t *testing.T) {
-	expectedErr := fmt.Errorf("not good")
-	query, queryResult := mockQueryResult()
-	mock := &mockAPI{
-		response: queryResult,
-		err:      expectedErr,
+func TestRunWithInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   map[string]json.RawMessage
+		expected string
+	}{
+		{
+			name:     "missing plugin config",
+			plugin:   map[string]json.RawMessage{},
+			expected: "unable to find honeycomb plugin config",
+		},
+		{
+			name:     "malformed plugin config",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":`)},
+			expected: "failed to parse honeycomb plugin config: unexpected end of JSON input",
+		},
+		{
+			name:     "missing query",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret"}`)},
+			expected: "invalid honeycomb plugin config: one of query, querySpec, queryID, queryAnnotation, slo, burnRate or triggers must be specified",
+		},
+		{
+			name:     "query and querySpec",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","querySpec":{"calculations":[{"op":"COUNT"}]},"apiKey":"secret"}`)},
+			expected: "invalid honeycomb plugin config: only one of query, querySpec, queryID, queryAnnotation, slo, burnRate and triggers can be specified",
+		},
+		{
+			name:     "invalid querySpec",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"querySpec":{"calculations":[{"op":"P98","column":"duration_ms"}]},"apiKey":"secret"}`)},
+			expected: `invalid honeycomb plugin config: querySpec is invalid: calculations[0]: unknown op "P98"`,
+		},
+		{
+			name:     "api key set inline and from a secret",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","apiKeySecretRef":{"name":"foo"}}`)},
+			expected: "invalid honeycomb plugin config: only one of apiKey and apiKeySecretRef can be specified",
+		},
+		{
+			name:     "invalid api url",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","apiURL":"api.eu1.honeycomb.io"}`)},
+			expected: `invalid honeycomb plugin config: apiURL is invalid: unsupported scheme ""`,
+		},
+		{
+			name:     "unknown group policy",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","groupPolicy":"some"}`)},
+			expected: "invalid honeycomb plugin config: groupPolicy must be one of all, any or majority",
+		},
+		{
+			name:     "comparison without baseline",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","comparison":{"column":"version","canary":"v2"}}`)},
+			expected: "invalid honeycomb plugin config: comparison is invalid: canary and baseline values must be specified",
+		},
+		{
+			name:     "comparison of OR filters",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"querySpec":{"calculations":[{"op":"COUNT"}],"filter_combination":"OR"},"apiKey":"secret","comparison":{"column":"version","canary":"v2","baseline":"v1"}}`)},
+			expected: "invalid honeycomb plugin config: comparison requires the AND filter_combination",
+		},
+		{
+			name:     "unknown comparison test",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","comparison":{"column":"version","canary":"v2","baseline":"v1","test":"chi-squared"}}`)},
+			expected: "invalid honeycomb plugin config: comparison is invalid: test must be one of mann-whitney or welch",
+		},
+		{
+			name:     "calculated field without name",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","calculatedFields":[{"expression":"1"}]}`)},
+			expected: "invalid honeycomb plugin config: calculatedFields[0] is invalid: name must be specified",
+		},
+		{
+			name:     "calculated field clashing with querySpec",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"querySpec":{"calculations":[{"op":"AVG","column":"is_error"}],"calculated_fields":[{"name":"is_error","expression":"1"}]},"apiKey":"secret","calculatedFields":[{"name":"is_error","expression":"0"}]}`)},
+			expected: "invalid honeycomb plugin config: calculated field is_error is defined more than once",
+		},
+		{
+			name:     "negative min samples",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","minSamples":-1}`)},
+			expected: "invalid honeycomb plugin config: minSamples cannot be negative",
+		},
+		{
+			name:     "freshness without max age",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","freshness":{"onStale":"failed"}}`)},
+			expected: `invalid honeycomb plugin config: freshness is invalid: maxAge is invalid: time: invalid duration ""`,
+		},
+		{
+			name:     "unknown freshness phase",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","freshness":{"maxAge":"5m","onStale":"error"}}`)},
+			expected: "invalid honeycomb plugin config: freshness is invalid: onStale must be one of inconclusive or failed",
+		},
+		{
+			name:     "query and slo",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","slo":{"id":"slo1"}}`)},
+			expected: "invalid honeycomb plugin config: only one of query, querySpec, queryID, queryAnnotation, slo, burnRate and triggers can be specified",
+		},
+		{
+			name:     "slo without id",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","slo":{"burnRateWindows":["1h"]}}`)},
+			expected: "invalid honeycomb plugin config: slo is invalid: id must be specified",
+		},
+		{
+			name:     "invalid burn rate window",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","slo":{"id":"slo1","burnRateWindows":["1h","0s"]}}`)},
+			expected: "invalid honeycomb plugin config: slo is invalid: burnRateWindows[1] must be positive",
+		},
+		{
+			name:     "slo with query options",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","slo":{"id":"slo1"},"minSamples":10}`)},
+			expected: "invalid honeycomb plugin config: minSamples can only be used with query or querySpec",
+		},
+		{
+			name:     "burn rate without good filter",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","burnRate":{"target":99.9,"windows":[{"short":"5m","long":"1h","threshold":14.4}]}}`)},
+			expected: "invalid honeycomb plugin config: burnRate is invalid: at least one good filter must be specified",
+		},
+		{
+			name:     "burn rate target out of range",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","burnRate":{"good":[{"column":"error","op":"does-not-exist"}],"target":100,"windows":[{"short":"5m","long":"1h","threshold":14.4}]}}`)},
+			expected: "invalid honeycomb plugin config: burnRate is invalid: target must be between 0 and 100",
+		},
+		{
+			name:     "burn rate short window longer than long window",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","burnRate":{"good":[{"column":"error","op":"does-not-exist"}],"target":99.9,"windows":[{"short":"1h","long":"5m","threshold":14.4}]}}`)},
+			expected: "invalid honeycomb plugin config: burnRate is invalid: windows[0]: short must be shorter than long",
+		},
+		{
+			name:     "burn rate with window",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","burnRate":{"good":[{"column":"error","op":"does-not-exist"}],"target":99.9,"windows":[{"short":"5m","long":"1h","threshold":14.4}]},"window":{}}`)},
+			expected: "invalid honeycomb plugin config: window can only be used with query or querySpec",
+		},
+		{
+			name:     "duplicate trigger",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","triggers":["t1","t2","t1"]}`)},
+			expected: "invalid honeycomb plugin config: trigger t1 is referenced more than once",
+		},
+		{
+			name:     "triggers with freshness",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","triggers":["t1"],"freshness":{"maxAge":"5m"}}`)},
+			expected: "invalid honeycomb plugin config: freshness can only be used with query or querySpec",
+		},
+		{
+			name:     "query id and query annotation",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","queryID":"q1","queryAnnotation":"checkout latency"}`)},
+			expected: "invalid honeycomb plugin config: only one of query, querySpec, queryID, queryAnnotation, slo, burnRate and triggers can be specified",
+		},
+		{
+			name:     "query id with window",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","queryID":"q1","window":{}}`)},
+			expected: "invalid honeycomb plugin config: window can only be used with query or querySpec",
+		},
+		{
+			name:     "query annotation with query options",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"apiKey":"secret","queryAnnotation":"checkout latency","calculatedFields":[{"name":"error_rate","expression":"IF($error, 1, 0)"}],"minSamples":10}`)},
+			expected: "invalid honeycomb plugin config: calculatedFields, minSamples can only be used with query or querySpec",
+		},
+		{
+			name:     "invalid ingestion lag",
+			plugin:   map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","window":{"ingestionLag":"-30s"}}`)},
+			expected: "invalid honeycomb plugin config: window is invalid: ingestionLag cannot be negative",
+		},
 	}
 
-	b, err := json.Marshal(query)
-	assert.NoError(t, err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := v1alpha1.Metric{
+				Name:     "foo",
+				Provider: v1alpha1.MetricProvider{Plugin: test.plugin},
+			}
+			p := newTestProvider(&mockAPI{})
 
-	config := Config{
-		Query:   string(b),
-		Dataset: "test",
-	}
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+			assert.Equal(t, test.expected, measurement.Message)
+			assert.NotNil(t, measurement.FinishedAt)
 
-	configBytes, err := json.Marshal(config)
-	assert.NoError(t, err)
+			assert.Empty(t, p.GetMetadata(metric))
+		})
+	}
+}
 
-	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
+func newHoneycombMetric(name string, query string) v1alpha1.Metric {
+	return v1alpha1.Metric{
+		Name: name,
 		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": configBytes},
+			Plugin: map[string]json.RawMessage{PluginName: []byte(fmt.Sprintf(`{"query":%q,"dataset":"test","apiKey":"secret"}`, query))},
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
+}
+
+func TestRunReusesQueryPerRunAndMetric(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newTestProvider(mock)
 
-	p.api = mock
+	run1 := &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{UID: "run-1"}}
+	run2 := &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{UID: "run-2"}}
+	// metrics with an interval and no count are measured until the AnalysisRun is terminated
+	errorCount := newHoneycombMetric("errors", `{"calculations":[{"op":"COUNT"}]}`)
+	errorCount.Interval = "1m"
+	latency := newHoneycombMetric("latency", `{"calculations":[{"op":"P99","column":"duration_ms"}]}`)
+	latency.Interval = "1m"
 
-	measurement := p.Run(newAnalysisRun(), metric)
-	assert.Equal(t, expectedErr.Error(), measurement.Message)
-	assert.NotNil(t, measurement.StartedAt)
-	assert.Equal(t, "", measurement.Value)
-	assert.NotNil(t, measurement.FinishedAt)
-	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	p.Run(run1, errorCount)
+	p.Run(run1, errorCount)
+	assert.Equal(t, 1, mock.createdQueries)
+	assert.Equal(t, []string{"query-1", "query-1"}, mock.queryIDs)
+
+	// every metric gets its own query
+	p.Run(run1, latency)
+	assert.Equal(t, 2, mock.createdQueries)
+	assert.Equal(t, "query-2", mock.queryIDs[2])
+
+	// every AnalysisRun gets its own query
+	p.Run(run2, errorCount)
+	assert.Equal(t, 3, mock.createdQueries)
+	assert.Equal(t, "query-3", mock.queryIDs[3])
+
+	// the query of a metric is replaced when its text changes
+	p.Run(run1, newHoneycombMetric("errors", `{"calculations":[{"op":"COUNT"}],"time_range":60}`))
+	assert.Equal(t, 4, mock.createdQueries)
+	assert.Equal(t, "query-4", mock.queryIDs[4])
+
+	p.Run(run1, latency)
+	assert.Equal(t, 4, mock.createdQueries)
+	assert.Equal(t, "query-2", mock.queryIDs[5])
 }
 
-func TestRunWithResolveArgsError(t *testing.T) {
-	expectedErr := fmt.Errorf("failed to resolve {{args.var}}")
+func TestGarbageCollectReleasesQueries(t *testing.T) {
+	_, queryResult := mockQueryResult()
 	mock := &mockAPI{
-		err: expectedErr,
+		response: queryResult,
 	}
+	p := newTestProvider(mock)
 
-	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
-		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": []byte(`{"query":"bar","dataset":"test"}`)},
-		},
+	run := &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{UID: "run-1"}}
+	metric := newHoneycombMetric("errors", `{"calculations":[{"op":"COUNT"}]}`)
+	metric.Interval = "1m"
+
+	// metrics are garbage collected while the AnalysisRun runs, their queries are still reused
+	p.Run(run, metric)
+	assert.Equal(t, pluginTypes.RpcError{}, p.GarbageCollect(run, metric, 10))
+	p.Run(run, metric)
+	assert.Equal(t, 1, mock.createdQueries)
+	assert.Equal(t, []string{"query-1", "query-1"}, mock.queryIDs)
+
+	run.Status.Phase = v1alpha1.AnalysisPhaseSuccessful
+	assert.Equal(t, pluginTypes.RpcError{}, p.GarbageCollect(run, metric, 10))
+	assert.Empty(t, p.queries.queries)
+}
+
+func TestFinalMeasurementReleasesQueries(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
+	p := newTestProvider(mock)
 
-	p.api = mock
+	run := &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{UID: "run-1"}}
+	metric := newHoneycombMetric("errors", `{"calculations":[{"op":"COUNT"}]}`)
+	metric.Interval = "1m"
+	metric.Count = ptr(intstr.FromInt(2))
 
-	measurement := p.Run(newAnalysisRun(), metric)
-	assert.Equal(t, expectedErr.Error(), measurement.Message)
-	assert.NotNil(t, measurement.StartedAt)
-	assert.Equal(t, "", measurement.Value)
-	assert.NotNil(t, measurement.FinishedAt)
-	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	measurement := p.Run(run, metric)
+	assert.Len(t, p.queries.queries, 1)
+	withMeasurement(run, metric.Name, measurement)
+
+	p.Run(run, metric)
+	assert.Empty(t, p.queries.queries)
+
+	// terminated metrics release their queries too
+	other := newHoneycombMetric("latency", `{"calculations":[{"op":"P99","column":"duration_ms"}]}`)
+	other.Interval = "1m"
+	measurement = p.Run(run, other)
+	assert.Len(t, p.queries.queries, 1)
+	p.Terminate(run, other, measurement)
+	assert.Empty(t, p.queries.queries)
 }
 
-func TestRunWithEvaluationError(t *testing.T) {
-	expectedErr := fmt.Errorf("no results returned")
-	query, queryResult := mockEmptyQueryResult()
+func TestQueryRegistryConcurrentAccess(t *testing.T) {
+	r := newQueryRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uid := types.UID(fmt.Sprintf("run-%d", i%5))
+			hash := hashQuery(fmt.Sprintf("query-%d", i), "test")
+			r.set(uid, "metric", "", hash, fmt.Sprintf("id-%d", i))
+			r.get(uid, "metric", "", hash)
+			r.forget(uid, "other")
+		}(i)
+	}
+	wg.Wait()
+
+	// only the latest query of each metric is kept
+	assert.Len(t, r.queries, 5)
+}
+
+func newAPIKeySecret(name string, key string, value string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "argo-rollouts",
+		},
+		Data: map[string][]byte{
+			key: []byte(value),
+		},
+	}
+}
 
+func TestRunWithAPIKeyFromSecret(t *testing.T) {
+	_, queryResult := mockQueryResult()
 	mock := &mockAPI{
 		response: queryResult,
-		err:      expectedErr,
 	}
 
-	b, err := json.Marshal(query)
-	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	config := Config{
-		Query:   string(b),
-		Dataset: "test",
+	clientset := fake.NewSimpleClientset(
+		newAPIKeySecret(HoneycombSecret, HoneycombAPIKey, "default-key"),
+		newAPIKeySecret("team-a", "token", "team-a-key"),
+	)
+	p := newTestProvider(mock)
+	p.secrets = newSecretStore(ctx, clientset, "argo-rollouts")
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "default secret",
+			config:   `{"query":"bar"}`,
+			expected: "default-key",
+		},
+		{
+			name:     "secret reference",
+			config:   `{"query":"bar","apiKeySecretRef":{"name":"team-a","key":"token"}}`,
+			expected: "team-a-key",
+		},
+		{
+			name:     "inline key",
+			config:   `{"query":"bar","apiKey":"inline-key"}`,
+			expected: "inline-key",
+		},
 	}
 
-	configBytes, err := json.Marshal(config)
-	assert.NoError(t, err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := v1alpha1.Metric{
+				Name: "foo",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(test.config)},
+				},
+			}
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+			assert.Equal(t, test.expected, mock.apiKey)
+		})
+	}
+}
+
+func TestRunPicksUpRotatedAPIKey(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientset := fake.NewSimpleClientset(newAPIKeySecret(HoneycombSecret, HoneycombAPIKey, "old-key"))
+	p := newTestProvider(mock)
+	p.secrets = newSecretStore(ctx, clientset, "argo-rollouts")
 
 	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
+		Name: "foo",
 		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": configBytes},
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar"}`)},
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
 
-	p.api = mock
+	p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, "old-key", mock.apiKey)
 
-	measurement := p.Run(newAnalysisRun(), metric)
-	assert.Equal(t, expectedErr.Error(), measurement.Message)
-	assert.NotNil(t, measurement.StartedAt)
-	assert.Equal(t, "", measurement.Value)
-	assert.NotNil(t, measurement.FinishedAt)
-	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	_, err := clientset.CoreV1().Secrets("argo-rollouts").Update(ctx, newAPIKeySecret(HoneycombSecret, HoneycombAPIKey, "new-key"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		p.Run(newAnalysisRun(), metric)
+		return mock.apiKey == "new-key"
+	}, 5*time.Second, 10*time.Millisecond)
 }
 
-func TestResume(t *testing.T) {
-	mock := &mockAPI{}
-	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
-		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": []byte(`{"query":"bar","dataset":"test"}`)},
+func TestRunWithMissingSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := newTestProvider(&mockAPI{})
+	p.secrets = newSecretStore(ctx, fake.NewSimpleClientset(newAPIKeySecret("team-a", "token", "team-a-key")), "argo-rollouts")
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "missing secret",
+			config:   `{"query":"bar"}`,
+			expected: "failed to read honeycomb API key: secret argo-rollouts/honeycomb not found",
+		},
+		{
+			name:     "missing key",
+			config:   `{"query":"bar","apiKeySecretRef":{"name":"team-a"}}`,
+			expected: `failed to read honeycomb API key: secret argo-rollouts/team-a has no "api-key" key`,
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
 
-	p.api = mock
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := v1alpha1.Metric{
+				Name: "foo",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(test.config)},
+				},
+			}
 
-	now := metav1.Now()
-	previousMeasurement := v1alpha1.Measurement{
-		StartedAt: &now,
-		Phase:     v1alpha1.AnalysisPhaseInconclusive,
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+			assert.Equal(t, test.expected, measurement.Message)
+		})
 	}
-	measurement := p.Resume(newAnalysisRun(), metric, previousMeasurement)
-	assert.Equal(t, previousMeasurement, measurement)
 }
 
-func TestTerminate(t *testing.T) {
-	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
-		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": []byte(`{"query":"bar","dataset":"test"}`)},
-		},
+func mockResults(op string, values ...interface{}) *QueryResult {
+	_, queryResult := mockQueryResult()
+	queryResult.Data.Results = make([]ResultsDatum, len(values))
+	for i, value := range values {
+		queryResult.Data.Results[i] = ResultsDatum{
+			Data: map[string]interface{}{op: value},
+		}
 	}
-	p, err := NewHoneycombProvider(metric)
-	assert.NoError(t, err)
+	return queryResult
+}
 
-	p.api = &mockAPI{}
-	now := metav1.Now()
-	previousMeasurement := v1alpha1.Measurement{
-		StartedAt: &now,
-		Phase:     v1alpha1.AnalysisPhaseRunning,
+func TestRunWithFloatingPointResults(t *testing.T) {
+	mock := &mockAPI{
+		response: mockResults("P99(duration_ms)", json.Number("210.5"), 250.25, json.Number("299.123456789012345")),
 	}
-	measurement := p.Terminate(newAnalysisRun(), metric, previousMeasurement)
-	assert.Equal(t, previousMeasurement, measurement)
+
+	metric := newHoneycombMetric("foo", "bar")
+	metric.SuccessCondition = "result < 299.2"
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, `[210.5, 250.25, 299.123456789012345]`, measurement.Value)
+
+	metric.SuccessCondition = "result < 299.1"
+	measurement = p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseFailed, measurement.Phase)
 }
 
-func TestGarbageCollect(t *testing.T) {
-	metric := v1alpha1.Metric{
-		Name:             "foo",
-		SuccessCondition: "result == 300",
-		FailureCondition: "result != 300",
-		Provider: v1alpha1.MetricProvider{
-			Plugin: map[string]json.RawMessage{"argoproj-labs/honeycomb": []byte(`{"query":"bar","dataset":"test"}`)},
+func TestRunWithNullResults(t *testing.T) {
+	tests := []struct {
+		name       string
+		nullValues string
+		values     []interface{}
+		value      string
+		expected   v1alpha1.AnalysisPhase
+	}{
+		{
+			name:     "skipped by default",
+			values:   []interface{}{json.Number("10"), nil},
+			value:    `[10, null]`,
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:       "skipped",
+			nullValues: NullValuesSkip,
+			values:     []interface{}{json.Number("10"), nil},
+			value:      `[10, null]`,
+			expected:   v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:       "every value skipped",
+			nullValues: NullValuesSkip,
+			values:     []interface{}{nil, nil},
+			value:      `[null, null]`,
+			expected:   v1alpha1.AnalysisPhaseInconclusive,
+		},
+		{
+			name:       "treated as zero",
+			nullValues: NullValuesZero,
+			values:     []interface{}{json.Number("10"), nil},
+			value:      `[10, null]`,
+			expected:   v1alpha1.AnalysisPhaseFailed,
+		},
+		{
+			name:       "inconclusive",
+			nullValues: NullValuesInconclusive,
+			values:     []interface{}{json.Number("10"), nil},
+			value:      `[10, null]`,
+			expected:   v1alpha1.AnalysisPhaseInconclusive,
 		},
 	}
-	p, err := NewHoneycombProvider(metric)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				response: mockResults("P99(duration_ms)", test.values...),
+			}
+
+			config := fmt.Sprintf(`{"query":"bar","apiKey":"secret","nullValues":%q}`, test.nullValues)
+			metric := v1alpha1.Metric{
+				Name:             "foo",
+				SuccessCondition: "result > 5",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(config)},
+				},
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.value, measurement.Value)
+		})
+	}
+}
+
+func TestRunWithUnexpectedResultType(t *testing.T) {
+	mock := &mockAPI{
+		response: mockResults("P99(duration_ms)", "fast"),
+	}
+
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), newHoneycombMetric("foo", "bar"))
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "unexpected calculation value fast of type string", measurement.Message)
+}
+
+func TestRunWithInvalidNullValues(t *testing.T) {
+	metric := v1alpha1.Metric{
+		Name: "foo",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","apiKey":"secret","nullValues":"ignore"}`)},
+		},
+	}
+	p := newTestProvider(&mockAPI{})
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "invalid honeycomb plugin config: nullValues must be one of skip, zero or inconclusive", measurement.Message)
+}
+
+func mockMultipleCalculationsResult() *QueryResult {
+	_, queryResult := mockQueryResult()
+	queryResult.Query.Breakdowns = nil
+	queryResult.Query.Calculations = []Calculation{
+		{Op: "COUNT"},
+		{Op: "SUM", Column: stringPtr("error")},
+		{Op: "P99", Column: stringPtr("duration_ms")},
+	}
+	queryResult.Data.Results = []ResultsDatum{
+		{
+			Data: map[string]interface{}{
+				"COUNT":            json.Number("2000"),
+				"SUM(error)":       json.Number("12"),
+				"P99(duration_ms)": json.Number("250.5"),
+			},
+		},
+	}
+	return queryResult
+}
+
+func TestRunWithMultipleCalculations(t *testing.T) {
+	tests := []struct {
+		name      string
+		aliases   string
+		condition string
+		expected  v1alpha1.AnalysisPhase
+		message   string
+	}{
+		{
+			name:      "first calculation as result",
+			condition: "result == 2000",
+			expected:  v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "calculations by name",
+			condition: `results["SUM(error)"] / results["COUNT"] < 0.01 && results["P99(duration_ms)"] < 300`,
+			expected:  v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "calculations by alias",
+			aliases:   `{"errors":"SUM(error)","total":"COUNT"}`,
+			condition: `results["errors"] / results["total"] < 0.005`,
+			expected:  v1alpha1.AnalysisPhaseFailed,
+		},
+		{
+			name:      "alias of an unknown calculation",
+			aliases:   `{"errors":"SUM(errors)"}`,
+			condition: `results["errors"] == 0`,
+			expected:  v1alpha1.AnalysisPhaseError,
+			message:   "alias errors refers to unknown calculation SUM(errors)",
+		},
+		{
+			name:      "alias clashing with a calculation",
+			aliases:   `{"COUNT":"SUM(error)"}`,
+			condition: `results["COUNT"] == 0`,
+			expected:  v1alpha1.AnalysisPhaseError,
+			message:   "alias COUNT clashes with a calculation of the query",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				response: mockMultipleCalculationsResult(),
+			}
+
+			aliases := test.aliases
+			if aliases == "" {
+				aliases = "{}"
+			}
+			config := fmt.Sprintf(`{"query":"bar","apiKey":"secret","aliases":%s}`, aliases)
+			metric := v1alpha1.Metric{
+				Name:             "foo",
+				SuccessCondition: test.condition,
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(config)},
+				},
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+		})
+	}
+}
+
+func mockBreakdownResult() *QueryResult {
+	_, queryResult := mockQueryResult()
+	queryResult.Query.Breakdowns = []string{"service.name", "http.status_code"}
+	queryResult.Data.Results = []ResultsDatum{
+		{Data: map[string]interface{}{"service.name": "api", "http.status_code": json.Number("200"), "P99(duration_ms)": json.Number("120")}},
+		{Data: map[string]interface{}{"service.name": "web", "http.status_code": json.Number("200"), "P99(duration_ms)": json.Number("450")}},
+		{Data: map[string]interface{}{"service.name": "worker", "http.status_code": json.Number("200"), "P99(duration_ms)": json.Number("90")}},
+		{Data: map[string]interface{}{"service.name": "web", "http.status_code": json.Number("500"), "P99(duration_ms)": json.Number("900")}},
+	}
+	return queryResult
+}
+
+func TestRunWithBreakdowns(t *testing.T) {
+	tests := []struct {
+		name             string
+		groupPolicy      string
+		successCondition string
+		failureCondition string
+		expected         v1alpha1.AnalysisPhase
+		message          string
+	}{
+		{
+			name:             "every group must pass by default",
+			successCondition: "result < 500",
+			expected:         v1alpha1.AnalysisPhaseFailed,
+			message:          "1 of 4 groups failed: service.name=web,http.status_code=500",
+		},
+		{
+			name:             "every group passes",
+			successCondition: `result < 500 || group["http.status_code"] >= 500`,
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:             "conditions using breakdown values",
+			successCondition: `group["service.name"] == "web" ? result < 1000 : result < 100`,
+			expected:         v1alpha1.AnalysisPhaseFailed,
+			message:          "1 of 4 groups failed: service.name=api,http.status_code=200",
+		},
+		{
+			name:             "inconclusive group",
+			groupPolicy:      GroupPolicyAll,
+			successCondition: "result < 200",
+			failureCondition: "result > 1000",
+			expected:         v1alpha1.AnalysisPhaseInconclusive,
+		},
+		{
+			name:             "any group fails",
+			groupPolicy:      GroupPolicyAny,
+			successCondition: "result < 200",
+			failureCondition: "result > 800",
+			expected:         v1alpha1.AnalysisPhaseFailed,
+			message:          "1 of 4 groups failed: service.name=web,http.status_code=500",
+		},
+		{
+			name:             "no group fails",
+			groupPolicy:      GroupPolicyAny,
+			successCondition: "result < 200",
+			failureCondition: "result > 1000",
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:             "majority of groups pass",
+			groupPolicy:      GroupPolicyMajority,
+			successCondition: "result < 500",
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+			message:          "1 of 4 groups failed: service.name=web,http.status_code=500",
+		},
+		{
+			name:             "majority of groups fail",
+			groupPolicy:      GroupPolicyMajority,
+			successCondition: "result < 100",
+			expected:         v1alpha1.AnalysisPhaseFailed,
+			message:          "3 of 4 groups failed: service.name=api,http.status_code=200; service.name=web,http.status_code=200; service.name=web,http.status_code=500",
+		},
+		{
+			name:             "no majority",
+			groupPolicy:      GroupPolicyMajority,
+			successCondition: "result < 200",
+			expected:         v1alpha1.AnalysisPhaseInconclusive,
+			message:          "2 of 4 groups failed: service.name=web,http.status_code=200; service.name=web,http.status_code=500",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				response: mockBreakdownResult(),
+			}
+
+			config := fmt.Sprintf(`{"query":"bar","apiKey":"secret","groupPolicy":%q}`, test.groupPolicy)
+			metric := v1alpha1.Metric{
+				Name:             "foo",
+				SuccessCondition: test.successCondition,
+				FailureCondition: test.failureCondition,
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(config)},
+				},
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, "[120, 450, 90, 900]", measurement.Value)
+		})
+	}
+}
+
+func TestRunWithAPIURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultAPIURL string
+		config        string
+		expected      string
+	}{
+		{
+			name:     "honeycomb API by default",
+			config:   `{"query":"bar","apiKey":"secret"}`,
+			expected: "",
+		},
+		{
+			name:          "plugin-wide default",
+			defaultAPIURL: "https://api.eu1.honeycomb.io",
+			config:        `{"query":"bar","apiKey":"secret"}`,
+			expected:      "https://api.eu1.honeycomb.io",
+		},
+		{
+			name:          "metric api url",
+			defaultAPIURL: "https://api.eu1.honeycomb.io",
+			config:        `{"query":"bar","apiKey":"secret","apiURL":"http://honeycomb.local:8080"}`,
+			expected:      "http://honeycomb.local:8080",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+			p.DefaultAPIURL = test.defaultAPIURL
+
+			metric := v1alpha1.Metric{
+				Name: "foo",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(test.config)},
+				},
+			}
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+			assert.Equal(t, test.expected, mock.baseURL)
+		})
+	}
+}
+
+func TestInitPluginWithInvalidDefaultAPIURL(t *testing.T) {
+	p := NewHoneycombProvider(*log.WithFields(log.Fields{"plugin": "honeycomb"}))
+	p.DefaultAPIURL = "ftp://api.honeycomb.io"
+
+	err := p.InitPlugin()
+	assert.Equal(t, `default honeycomb API URL is invalid: unsupported scheme "ftp"`, err.Error())
+}
+
+func TestRunWithQuerySpec(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result < 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{
+				"apiKey": "secret",
+				"dataset": "test",
+				"querySpec": {
+					"time_range": 600,
+					"breakdowns": ["user_agent"],
+					"calculations": [{"op": "P99", "column": "duration_ms"}],
+					"filters": [
+						{"column": "service.name", "op": "=", "value": "api"},
+						{"column": "error", "op": "does-not-exist"}
+					],
+					"filter_combination": "AND",
+					"orders": [{"op": "P99", "column": "duration_ms", "order": "descending"}]
+				}
+			}`)},
+		},
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+
+	expected := `{"breakdowns":["user_agent"],"calculations":[{"op":"P99","column":"duration_ms"}],` +
+		`"filters":[{"op":"=","column":"service.name","value":"api"},{"op":"does-not-exist","column":"error"}],` +
+		`"filter_combination":"AND","orders":[{"column":"duration_ms","op":"P99","order":"descending"}],"time_range":600}`
+	assert.Equal(t, expected, mock.query)
+	assert.Equal(t, expected, p.GetMetadata(metric)[ResolvedHoneycombQuery])
+}
+
+func TestGetMetadata(t *testing.T) {
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result < 300",
+		FailureCondition: "result > 310",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","dataset":"test","apiKey":"secret"}`)},
+		},
+	}
+	p := newTestProvider(&mockAPI{})
+
+	metadata := p.GetMetadata(metric)
+	assert.Equal(t, "bar", metadata[ResolvedHoneycombQuery])
+}
+
+func newRolloutAnalysisRun() *v1alpha1.AnalysisRun {
+	return &v1alpha1.AnalysisRun{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "guestbook-6c54f8f7d5-2-1",
+			Namespace: "shop",
+			UID:       "run-uid",
+			Labels: map[string]string{
+				v1alpha1.DefaultRolloutUniqueLabelKey: "6c54f8f7d5",
+				"app":                                 "guestbook",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Rollout", Name: "guestbook", Controller: ptr(true)},
+			},
+		},
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRunWithQueryTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		run       *v1alpha1.AnalysisRun
+		interval  v1alpha1.DurationString
+		query     string
+		querySpec string
+		expected  string
+		message   string
+	}{
+		{
+			name:     "analysis run context",
+			run:      newRolloutAnalysisRun(),
+			interval: "5m",
+			query:    `{"time_range":[[ .IntervalSeconds ]],"filters":[{"column":"k8s.pod.labels.rollouts-pod-template-hash","op":"=","value":"[[ .PodTemplateHash ]]"}]}`,
+			expected: `{"time_range":300,"filters":[{"column":"k8s.pod.labels.rollouts-pod-template-hash","op":"=","value":"6c54f8f7d5"}]}`,
+		},
+		{
+			name:     "names and labels",
+			run:      newRolloutAnalysisRun(),
+			query:    `[[ .Namespace ]]/[[ .Rollout ]]/[[ .AnalysisRun ]]/[[ .Metric ]]/[[ index .Labels "app" ]]/[[ .Interval ]]`,
+			expected: `shop/guestbook/guestbook-6c54f8f7d5-2-1/foo/guestbook/`,
+		},
+		{
+			name:     "analysis run without rollout",
+			run:      &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{Name: "adhoc", Namespace: "shop"}},
+			query:    `[[ .Rollout ]]-[[ .PodTemplateHash ]]-[[ .AnalysisRun ]]`,
+			expected: `--adhoc`,
+		},
+		{
+			name:      "query spec",
+			run:       newRolloutAnalysisRun(),
+			querySpec: `{"calculations":[{"op":"COUNT"}],"filters":[{"column":"app","op":"in","value":["[[ index .Labels \"app\" ]]","web"]},{"column":"k8s.pod.labels.rollouts-pod-template-hash","op":"=","value":"[[ .PodTemplateHash ]]"}],"calculated_fields":[{"name":"canary","expression":"EQUALS($rollout, \"[[ .Rollout ]]\")"}]}`,
+			expected:  `{"calculations":[{"op":"COUNT"}],"filters":[{"op":"in","column":"app","value":["guestbook","web"]},{"op":"=","column":"k8s.pod.labels.rollouts-pod-template-hash","value":"6c54f8f7d5"}],"calculated_fields":[{"name":"canary","expression":"EQUALS($rollout, \"guestbook\")"}]}`,
+		},
+		{
+			name:     "query without template",
+			run:      newRolloutAnalysisRun(),
+			query:    `{"calculations":[{"op":"COUNT"}]}`,
+			expected: `{"calculations":[{"op":"COUNT"}]}`,
+		},
+		{
+			name:    "invalid template",
+			run:     newRolloutAnalysisRun(),
+			query:   `[[ .Namespace `,
+			message: "failed to parse query template: template: query:1: unclosed action",
+		},
+		{
+			name:    "unknown field",
+			run:     newRolloutAnalysisRun(),
+			query:   `[[ .Revision ]]`,
+			message: `failed to render query template: template: query:1:3: executing "query" at <.Revision>: can't evaluate field Revision in type *plugin.queryContext`,
+		},
+		{
+			name:     "invalid interval",
+			run:      newRolloutAnalysisRun(),
+			interval: "often",
+			query:    `[[ .IntervalSeconds ]]`,
+			message:  `invalid interval "often": time: invalid duration "often"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			metric := newHoneycombMetric("foo", test.query)
+			if test.querySpec != "" {
+				metric.Provider.Plugin[PluginName] = []byte(fmt.Sprintf(`{"querySpec":%s,"dataset":"test","apiKey":"secret"}`, test.querySpec))
+			}
+			metric.Interval = test.interval
+			measurement := p.Run(test.run, metric)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, test.expected, mock.query)
+		})
+	}
+}
+
+func TestRunWithWindow(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	startedAt := metav1.NewTime(now.Add(-10 * time.Minute))
+	finishedAt := metav1.NewTime(now.Add(-5 * time.Minute))
+
+	tests := []struct {
+		name         string
+		measurements []v1alpha1.Measurement
+		startedAt    *metav1.Time
+		start        time.Time
+		phase        v1alpha1.AnalysisPhase
+		message      string
+	}{
+		{
+			name:      "first measurement",
+			startedAt: &startedAt,
+			start:     startedAt.Add(-30 * time.Second),
+			phase:     v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "first measurement at the start",
+			startedAt: ptr(metav1.NewTime(now)),
+			start:     now.Add(-30 * time.Second),
+			phase:     v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "after a measurement",
+			startedAt: &startedAt,
+			measurements: []v1alpha1.Measurement{
+				{FinishedAt: &finishedAt, Metadata: map[string]string{HoneycombWindowEnd: now.Add(-6 * time.Minute).Format(time.RFC3339)}},
+			},
+			start: now.Add(-6 * time.Minute),
+			phase: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "after a measurement without window",
+			startedAt: &startedAt,
+			measurements: []v1alpha1.Measurement{
+				{FinishedAt: &finishedAt},
+			},
+			start: finishedAt.Add(-30 * time.Second),
+			phase: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "after a measurement which errored",
+			startedAt: &startedAt,
+			measurements: []v1alpha1.Measurement{
+				{Phase: v1alpha1.AnalysisPhaseSuccessful, FinishedAt: &finishedAt, Metadata: map[string]string{HoneycombWindowEnd: now.Add(-6 * time.Minute).Format(time.RFC3339)}},
+				{Phase: v1alpha1.AnalysisPhaseError, FinishedAt: &finishedAt, Metadata: map[string]string{HoneycombWindowEnd: now.Add(-90 * time.Second).Format(time.RFC3339)}},
+			},
+			start: now.Add(-6 * time.Minute),
+			phase: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "after the window of the previous measurement",
+			startedAt: &startedAt,
+			measurements: []v1alpha1.Measurement{
+				{FinishedAt: &finishedAt, Metadata: map[string]string{HoneycombWindowEnd: now.Add(time.Minute).Format(time.RFC3339)}},
+			},
+			start: now.Add(time.Minute),
+			phase: v1alpha1.AnalysisPhaseInconclusive,
+		},
+		{
+			name:    "without start",
+			phase:   v1alpha1.AnalysisPhaseError,
+			message: "unable to determine when the AnalysisRun started",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			run := newAnalysisRun()
+			run.Status.StartedAt = test.startedAt
+			run.Status.MetricResults = []v1alpha1.MetricResult{
+				{Name: "other"},
+				{Name: "foo", Measurements: test.measurements},
+			}
+
+			metric := newHoneycombMetric("foo", "bar")
+			metric.Provider.Plugin[PluginName] = []byte(`{"query":"{\"time_range\":7200,\"calculations\":[{\"op\":\"P99\",\"column\":\"duration_ms\"}]}","apiKey":"secret","window":{"ingestionLag":"30s"}}`)
+			measurement := p.Run(run, metric)
+			assert.Equal(t, test.phase, measurement.Phase, measurement.Message)
+			if test.message != "" {
+				assert.Equal(t, test.message, measurement.Message)
+			}
+			if test.phase != v1alpha1.AnalysisPhaseSuccessful {
+				assert.Empty(t, mock.query)
+				if !test.start.IsZero() {
+					// an empty window ends where it starts
+					assert.Equal(t, test.start.Format(time.RFC3339), measurement.Metadata[HoneycombWindowStart])
+					assert.Equal(t, test.start.Format(time.RFC3339), measurement.Metadata[HoneycombWindowEnd])
+				}
+				return
+			}
+
+			var query map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(mock.query), &query))
+			assert.NotContains(t, query, "time_range")
+			assert.Equal(t, float64(test.start.Unix()), query["start_time"])
+			end := int64(query["end_time"].(float64))
+			assert.InDelta(t, now.Add(-30*time.Second).Unix(), end, 2)
+			assert.Equal(t, test.start.Format(time.RFC3339), measurement.Metadata[HoneycombWindowStart])
+			assert.Equal(t, time.Unix(end, 0).UTC().Format(time.RFC3339), measurement.Metadata[HoneycombWindowEnd])
+		})
+	}
+}
+
+func TestRunWithCompareTimeOffset(t *testing.T) {
+	comparison := func(service string, value interface{}) ResultsDatum {
+		datum := serviceResult(service, value)
+		datum.Data[comparisonMember] = true
+		return datum
+	}
+
+	tests := []struct {
+		name       string
+		nullValues string
+		results    []ResultsDatum
+		expected   v1alpha1.AnalysisPhase
+		message    string
+		value      string
+		previous   string
+	}{
+		{
+			name: "same as last week",
+			results: []ResultsDatum{
+				serviceResult("api", json.Number("110")), serviceResult("web", json.Number("300")),
+				comparison("api", json.Number("100")), comparison("web", json.Number("290")),
+			},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "[110, 300]",
+			previous: "[100, 290]",
+		},
+		{
+			name: "slower than last week",
+			results: []ResultsDatum{
+				serviceResult("api", json.Number("110")), serviceResult("web", json.Number("400")),
+				comparison("web", json.Number("290")), comparison("api", json.Number("100")),
+			},
+			expected: v1alpha1.AnalysisPhaseFailed,
+			message:  "1 of 2 groups failed: service.name=web",
+			value:    "[110, 400]",
+			previous: "[290, 100]",
+		},
+		{
+			name: "group missing last week",
+			results: []ResultsDatum{
+				serviceResult("api", json.Number("110")), serviceResult("web", json.Number("400")),
+				comparison("api", json.Number("100")),
+			},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "[110, 400]",
+			previous: "[100]",
+		},
+		{
+			name:       "group missing last week is inconclusive",
+			nullValues: NullValuesInconclusive,
+			results: []ResultsDatum{
+				serviceResult("api", json.Number("110")), serviceResult("web", json.Number("400")),
+				comparison("api", json.Number("100")),
+			},
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			value:    "[110, 400]",
+			previous: "[100]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			queryResult.Query.Breakdowns = []string{"service.name"}
+			queryResult.Query.CompareTimeOffsetSeconds = 604800
+			queryResult.Data.Results = test.results
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			config := fmt.Sprintf(`{"querySpec":{"calculations":[{"op":"P99","column":"duration_ms"}],"breakdowns":["service.name"],"compare_time_offset_seconds":604800},"apiKey":"secret","nullValues":%q}`, test.nullValues)
+			metric := v1alpha1.Metric{
+				Name:             "foo",
+				SuccessCondition: "result / previous < 1.2",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(config)},
+				},
+			}
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, test.value, measurement.Value)
+			assert.Equal(t, test.previous, measurement.Metadata[HoneycombPreviousValue])
+			assert.Contains(t, mock.query, `"compare_time_offset_seconds":604800`)
+		})
+	}
+}
+
+func TestRunWithCalculatedFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+		message  string
+	}{
+		{
+			name:     "added to the query",
+			query:    `{"calculations":[{"op":"AVG","column":"is_error"}],"filters":[{"column":"is_error","op":"exists"}]}`,
+			expected: `{"calculated_fields":[{"name":"is_error","expression":"IF(GTE($http.status_code, 500), 1, 0)"}],"calculations":[{"column":"is_error","op":"AVG"}],"filters":[{"column":"is_error","op":"exists"}]}`,
+		},
+		{
+			name:     "added to the calculated fields of the query",
+			query:    `{"calculations":[{"op":"AVG","column":"is_error"}],"calculated_fields":[{"name":"is_slow","expression":"GT($duration_ms, 500)"}]}`,
+			expected: `{"calculated_fields":[{"expression":"GT($duration_ms, 500)","name":"is_slow"},{"name":"is_error","expression":"IF(GTE($http.status_code, 500), 1, 0)"}],"calculations":[{"column":"is_error","op":"AVG"}]}`,
+		},
+		{
+			name:    "defined twice",
+			query:   `{"calculations":[{"op":"AVG","column":"is_error"}],"calculated_fields":[{"name":"is_error","expression":"1"}]}`,
+			message: "calculated field is_error is defined more than once",
+		},
+		{
+			name:    "invalid query",
+			query:   `bar`,
+			message: "failed to parse query: invalid character 'b' looking for beginning of value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			config := fmt.Sprintf(`{"query":%q,"apiKey":"secret","calculatedFields":[{"name":"is_error","expression":"IF(GTE($http.status_code, 500), 1, 0)"}]}`, test.query)
+			metric := newHoneycombMetric("foo", "bar")
+			metric.Provider.Plugin[PluginName] = []byte(config)
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, test.expected, mock.query)
+		})
+	}
+}
+
+func TestRunWithMinSamples(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		counts   []interface{}
+		expected v1alpha1.AnalysisPhase
+		message  string
+		sent     string
+	}{
+		{
+			name:     "enough events",
+			query:    `{"calculations":[{"op":"P99","column":"duration_ms"}]}`,
+			counts:   []interface{}{json.Number("60"), json.Number("50")},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			sent:     `{"calculations":[{"column":"duration_ms","op":"P99"},{"op":"COUNT"}]}`,
+		},
+		{
+			name:     "too few events",
+			query:    `{"calculations":[{"op":"P99","column":"duration_ms"}]}`,
+			counts:   []interface{}{json.Number("60"), json.Number("5")},
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			message:  "only 65 events, fewer than the 100 required by minSamples",
+			sent:     `{"calculations":[{"column":"duration_ms","op":"P99"},{"op":"COUNT"}]}`,
+		},
+		{
+			name:     "no events",
+			query:    `{"calculations":[{"op":"P99","column":"duration_ms"},{"op":"COUNT"}]}`,
+			counts:   []interface{}{nil, nil},
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			message:  "only 0 events, fewer than the 100 required by minSamples",
+			sent:     `{"calculations":[{"column":"duration_ms","op":"P99"},{"op":"COUNT"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queryResult := mockResults("P99(duration_ms)", json.Number("210"), json.Number("250"))
+			queryResult.Query.Calculations = append(queryResult.Query.Calculations, Calculation{Op: "COUNT"})
+			for i, count := range test.counts {
+				queryResult.Data.Results[i].Data["COUNT"] = count
+			}
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			metric := newHoneycombMetric("foo", "bar")
+			metric.SuccessCondition = "result < 300"
+			metric.Provider.Plugin[PluginName] = []byte(fmt.Sprintf(`{"query":%q,"apiKey":"secret","minSamples":100}`, test.query))
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, "[210, 250]", measurement.Value)
+			assert.Equal(t, test.sent, mock.query)
+		})
+	}
+}
+
+func TestRunWithFreshness(t *testing.T) {
+	now := time.Now().UTC()
+	bucket := func(age time.Duration, count interface{}) SeriesDatum {
+		return SeriesDatum{
+			Time: now.Add(-age).Format(time.RFC3339),
+			Data: map[string]interface{}{"P99(duration_ms)": json.Number("210"), "COUNT": count},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		onStale  string
+		series   []SeriesDatum
+		expected v1alpha1.AnalysisPhase
+		message  string
+	}{
+		{
+			name:     "fresh events",
+			series:   []SeriesDatum{bucket(10*time.Minute, json.Number("20")), bucket(4*time.Minute, json.Number("12")), bucket(2*time.Minute, json.Number("0"))},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:     "stale events",
+			series:   []SeriesDatum{bucket(4*time.Minute, json.Number("0")), bucket(10*time.Minute, json.Number("20"))},
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			message:  "latest events are 9m0s old, older than the maxAge of 5m",
+		},
+		{
+			name:     "stale events fail",
+			onStale:  OnStaleFailed,
+			series:   []SeriesDatum{bucket(10*time.Minute, json.Number("20")), bucket(4*time.Minute, nil)},
+			expected: v1alpha1.AnalysisPhaseFailed,
+			message:  "latest events are 9m0s old, older than the maxAge of 5m",
+		},
+		{
+			name:     "no events",
+			onStale:  OnStaleFailed,
+			series:   []SeriesDatum{bucket(4*time.Minute, json.Number("0"))},
+			expected: v1alpha1.AnalysisPhaseFailed,
+			message:  "no events in the query result",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queryResult := mockResults("P99(duration_ms)", json.Number("210"))
+			queryResult.Query.Breakdowns = nil
+			queryResult.Query.Granularity = 60
+			queryResult.Data.Series = test.series
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			metric := newHoneycombMetric("foo", "bar")
+			metric.SuccessCondition = "result < 300"
+			metric.Provider.Plugin[PluginName] = []byte(fmt.Sprintf(`{"query":"{\"calculations\":[{\"op\":\"P99\",\"column\":\"duration_ms\"}]}","apiKey":"secret","freshness":{"maxAge":"5m","onStale":%q}}`, test.onStale))
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Contains(t, mock.query, `{"op":"COUNT"}`)
+		})
+	}
+}
+
+func TestRunWithSeriesConditions(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  v1alpha1.AnalysisPhase
+	}{
+		{condition: "seriesMax(series) < 300", expected: v1alpha1.AnalysisPhaseSuccessful},
+		{condition: "seriesMin(series) > 210", expected: v1alpha1.AnalysisPhaseFailed},
+		{condition: "seriesAvg(series) == 230", expected: v1alpha1.AnalysisPhaseSuccessful},
+		{condition: "seriesLast(series) == 250", expected: v1alpha1.AnalysisPhaseSuccessful},
+		{condition: "slope(series) <= 0", expected: v1alpha1.AnalysisPhaseFailed},
+		{condition: "countAbove(series, 200) < 2", expected: v1alpha1.AnalysisPhaseFailed},
+		{condition: "len(series) == 2 && series[0].value == 210 && series[1].time > series[0].time", expected: v1alpha1.AnalysisPhaseSuccessful},
+		{condition: "max(series) > 0", expected: v1alpha1.AnalysisPhaseError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			_, queryResult := mockQueryResult()
+			queryResult.Query.Breakdowns = nil
+			mock := &mockAPI{
+				response: queryResult,
+			}
+			p := newTestProvider(mock)
+
+			metric := newHoneycombMetric("foo", "bar")
+			metric.SuccessCondition = test.condition
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase, measurement.Message)
+		})
+	}
+}
+
+func newComparisonMetric(successCondition string, nullValues string) v1alpha1.Metric {
+	return newComparisonTestMetric(successCondition, nullValues, "")
+}
+
+func newComparisonTestMetric(successCondition string, nullValues string, test string) v1alpha1.Metric {
+	config := fmt.Sprintf(`{
+		"query": "{\"calculations\":[{\"op\":\"P99\",\"column\":\"duration_ms\"}],\"breakdowns\":[\"service.name\"],\"filters\":[{\"column\":\"env\",\"op\":\"=\",\"value\":\"prod\"}]}",
+		"apiKey": "secret",
+		"nullValues": %q,
+		"comparison": {"column": "version", "canary": "v2", "baseline": "v1", "test": %q}
+	}`, nullValues, test)
+	return v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: successCondition,
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(config)},
+		},
+	}
+}
+
+// comparisonResponses responds to the canary and the baseline queries of newComparisonMetric
+func comparisonResponses(canary []ResultsDatum, baseline []ResultsDatum) func(query string) *QueryResult {
+	return func(query string) *QueryResult {
+		_, queryResult := mockQueryResult()
+		queryResult.Query.Breakdowns = []string{"service.name"}
+		if strings.Contains(query, `"value":"v1"`) {
+			queryResult.Data.Results = baseline
+		} else {
+			queryResult.Data.Results = canary
+		}
+		return queryResult
+	}
+}
+
+func serviceResult(service string, value interface{}) ResultsDatum {
+	return ResultsDatum{Data: map[string]interface{}{"service.name": service, "P99(duration_ms)": value}}
+}
+
+func TestRunWithComparison(t *testing.T) {
+	tests := []struct {
+		name             string
+		nullValues       string
+		successCondition string
+		canary           []ResultsDatum
+		baseline         []ResultsDatum
+		expected         v1alpha1.AnalysisPhase
+		message          string
+	}{
+		{
+			name:             "canary as fast as the baseline",
+			successCondition: "canary <= baseline * 1.1",
+			canary:           []ResultsDatum{serviceResult("api", json.Number("105")), serviceResult("web", json.Number("300"))},
+			baseline:         []ResultsDatum{serviceResult("web", json.Number("290")), serviceResult("api", json.Number("100"))},
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:             "canary slower than the baseline",
+			successCondition: "canary <= baseline * 1.1",
+			canary:           []ResultsDatum{serviceResult("api", json.Number("105")), serviceResult("web", json.Number("400"))},
+			baseline:         []ResultsDatum{serviceResult("api", json.Number("100")), serviceResult("web", json.Number("290"))},
+			expected:         v1alpha1.AnalysisPhaseFailed,
+			message:          "1 of 2 groups failed: service.name=web",
+		},
+		{
+			name:             "group missing from the baseline is skipped",
+			successCondition: "canary <= baseline * 1.1",
+			canary:           []ResultsDatum{serviceResult("api", json.Number("105")), serviceResult("web", json.Number("400"))},
+			baseline:         []ResultsDatum{serviceResult("api", json.Number("100"))},
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:             "group missing from the baseline is inconclusive",
+			nullValues:       NullValuesInconclusive,
+			successCondition: "canary <= baseline * 1.1",
+			canary:           []ResultsDatum{serviceResult("api", json.Number("105")), serviceResult("web", json.Number("400"))},
+			baseline:         []ResultsDatum{serviceResult("api", json.Number("100"))},
+			expected:         v1alpha1.AnalysisPhaseInconclusive,
+		},
+		{
+			name:             "group missing from the baseline is zero",
+			nullValues:       NullValuesZero,
+			successCondition: "baseline == 0 || canary <= baseline * 1.1",
+			canary:           []ResultsDatum{serviceResult("api", json.Number("105")), serviceResult("web", json.Number("400"))},
+			baseline:         []ResultsDatum{serviceResult("api", json.Number("100"))},
+			expected:         v1alpha1.AnalysisPhaseSuccessful,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				responseFor: comparisonResponses(test.canary, test.baseline),
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), newComparisonMetric(test.successCondition, test.nullValues))
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, measurement.Value, measurement.Metadata[HoneycombCanaryValue])
+			assert.NotEmpty(t, measurement.Metadata[HoneycombBaselineValue])
+		})
+	}
+}
+
+// serviceSeries returns a series of the P99(duration_ms) of a service, with a null bucket
+func serviceSeries(service string, values ...float64) []SeriesDatum {
+	series := []SeriesDatum{{Time: "2021-04-09T14:15:00Z", Data: map[string]interface{}{"service.name": service, "P99(duration_ms)": nil}}}
+	for i, value := range values {
+		series = append(series, SeriesDatum{
+			Time: fmt.Sprintf("2021-04-09T14:%02d:00Z", 16+i),
+			Data: map[string]interface{}{"service.name": service, "P99(duration_ms)": json.Number(fmt.Sprint(value))},
+		})
+	}
+	return series
+}
+
+func TestRunWithComparisonSignificance(t *testing.T) {
+	tests := []struct {
+		name      string
+		test      string
+		condition string
+		canary    []SeriesDatum
+		expected  v1alpha1.AnalysisPhase
+		message   string
+	}{
+		{
+			name:     "canary slower with mann-whitney",
+			canary:   append(serviceSeries("api", 130, 135, 128, 140, 132, 138), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+			expected: v1alpha1.AnalysisPhaseFailed,
+			message:  "1 of 2 groups failed: service.name=api",
+		},
+		{
+			name:     "canary slower with welch",
+			test:     ComparisonTestWelch,
+			canary:   append(serviceSeries("api", 130, 135, 128, 140, 132, 138), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+			expected: v1alpha1.AnalysisPhaseFailed,
+			message:  "1 of 2 groups failed: service.name=api",
+		},
+		{
+			name:     "canary faster",
+			test:     ComparisonTestWelch,
+			canary:   append(serviceSeries("api", 80, 85, 78, 90, 82, 88), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "canary slower with both tests",
+			condition: "mannWhitney.pValue >= 0.05 || welch.pValue >= 0.05 || welch.effectSize < 0",
+			canary:    append(serviceSeries("api", 130, 135, 128, 140, 132, 138), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+			expected:  v1alpha1.AnalysisPhaseFailed,
+			message:   "1 of 2 groups failed: service.name=api",
+		},
+		{
+			name:      "both tests run whatever the selected test",
+			test:      ComparisonTestWelch,
+			condition: "mannWhitney.statistic == 36 && mannWhitney.effectSize == 1 && welch.pValue == pValue",
+			canary:    append(serviceSeries("api", 130, 135, 128, 140, 132, 138), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+			expected:  v1alpha1.AnalysisPhaseFailed,
+			message:   "1 of 2 groups failed: service.name=web",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baselineSeries := append(serviceSeries("api", 100, 105, 98, 110, 102, 108), serviceSeries("web", 298, 312, 292, 303, 297, 300)...)
+			mock := &mockAPI{
+				responseFor: func(query string) *QueryResult {
+					queryResult := comparisonResponses(
+						[]ResultsDatum{serviceResult("api", json.Number("140")), serviceResult("web", json.Number("310"))},
+						[]ResultsDatum{serviceResult("api", json.Number("110")), serviceResult("web", json.Number("312"))},
+					)(query)
+					queryResult.Data.Series = test.canary
+					if strings.Contains(query, `"value":"v1"`) {
+						queryResult.Data.Series = baselineSeries
+					}
+					return queryResult
+				},
+			}
+			p := newTestProvider(mock)
+
+			condition := test.condition
+			if condition == "" {
+				condition = "pValue >= 0.05 || effectSize < 0"
+			}
+			metric := newComparisonTestMetric(condition, "", test.test)
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+		})
+	}
+}
+
+func TestRunWithComparisonBreakdown(t *testing.T) {
+	// versioned tags the rows and buckets of the result with a version
+	versioned := func(version string, results []ResultsDatum, series []SeriesDatum) ([]ResultsDatum, []SeriesDatum) {
+		for _, datum := range results {
+			datum.Data["version"] = version
+		}
+		for _, datum := range series {
+			datum.Data.(map[string]interface{})["version"] = version
+		}
+		return results, series
+	}
+	canaryResults, canarySeries := versioned("v2",
+		[]ResultsDatum{serviceResult("api", json.Number("140")), serviceResult("web", json.Number("310"))},
+		append(serviceSeries("api", 130, 135, 128, 140, 132, 138), serviceSeries("web", 300, 310, 290, 305, 295, 302)...),
+	)
+	baselineResults, baselineSeries := versioned("v1",
+		[]ResultsDatum{serviceResult("web", json.Number("312")), serviceResult("api", json.Number("110"))},
+		append(serviceSeries("api", 100, 105, 98, 110, 102, 108), serviceSeries("web", 298, 312, 292, 303, 297, 300)...),
+	)
+	// other versions are left out
+	otherResults, otherSeries := versioned("v0",
+		[]ResultsDatum{serviceResult("api", json.Number("900"))},
+		serviceSeries("api", 900, 910, 890),
+	)
+
+	_, queryResult := mockQueryResult()
+	queryResult.Query.Breakdowns = []string{"service.name", "version"}
+	queryResult.Data.Results = slices.Concat(canaryResults, otherResults, baselineResults)
+	queryResult.Data.Series = slices.Concat(canarySeries, otherSeries, baselineSeries)
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newTestProvider(mock)
+
+	metric := newComparisonMetric("pValue >= 0.05 || effectSize < 0", "")
+	metric.Provider.Plugin[PluginName] = []byte(`{
+		"query": "{\"calculations\":[{\"op\":\"P99\",\"column\":\"duration_ms\"}],\"breakdowns\":[\"service.name\"]}",
+		"apiKey": "secret",
+		"comparison": {"column": "version", "canary": "v2", "baseline": "v1", "breakdown": true}
+	}`)
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseFailed, measurement.Phase)
+	assert.Equal(t, "1 of 2 groups failed: service.name=api", measurement.Message)
+	assert.Equal(t, "[140, 310]", measurement.Value)
+	assert.Equal(t, "[312, 110]", measurement.Metadata[HoneycombBaselineValue])
+	assert.Equal(t, 1, mock.createdQueries)
+	assert.JSONEq(t, `{
+		"calculations": [{"op": "P99", "column": "duration_ms"}],
+		"breakdowns": ["service.name", "version"],
+		"filters": [{"column": "version", "op": "in", "value": ["v2", "v1"]}]
+	}`, mock.query)
+	assert.NotContains(t, measurement.Metadata, HoneycombQueryID+".baseline")
+}
+
+func TestRunAndResumeComparison(t *testing.T) {
+	mock := &mockAPI{
+		pendingResults: 1,
+		responseFor: comparisonResponses(
+			[]ResultsDatum{serviceResult("api", json.Number("105"))},
+			[]ResultsDatum{serviceResult("api", json.Number("100"))},
+		),
+	}
+	metric := newComparisonMetric("canary - baseline < 10", "")
+	metric.Interval = "1m"
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, "result-1", measurement.Metadata[HoneycombQueryResultID])
+	assert.Equal(t, "result-2", measurement.Metadata[HoneycombQueryResultID+".baseline"])
+	assert.Equal(t, "query-1", measurement.Metadata[HoneycombQueryID])
+	assert.Equal(t, "query-2", measurement.Metadata[HoneycombQueryID+".baseline"])
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, "[105]", measurement.Value)
+	assert.Equal(t, "[105]", measurement.Metadata[HoneycombCanaryValue])
+	assert.Equal(t, "[100]", measurement.Metadata[HoneycombBaselineValue])
+	assert.Equal(t, []string{"result-1", "result-2"}, mock.queryResultIDs)
+
+	// both queries keep the filters of the metric and are reused by the next measurement
+	assert.Equal(t, 2, mock.createdQueries)
+	assert.Contains(t, mock.queryTexts["query-1"], `{"column":"env","op":"=","value":"prod"},{"op":"=","column":"version","value":"v2"}`)
+	assert.Contains(t, mock.queryTexts["query-2"], `{"column":"env","op":"=","value":"prod"},{"op":"=","column":"version","value":"v1"}`)
+
+	p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, 2, mock.createdQueries)
+	assert.Equal(t, []string{"query-1", "query-2", "query-1", "query-2"}, mock.queryIDs)
+
+	metadata := p.GetMetadata(metric)
+	assert.Equal(t, mock.queryTexts["query-1"], metadata[ResolvedHoneycombQuery])
+	assert.Equal(t, mock.queryTexts["query-2"], metadata[ResolvedHoneycombQuery+".baseline"])
+}
+
+func TestRunWithQueryError(t *testing.T) {
+	expectedErr := fmt.Errorf("not good")
+	query, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+		err:      expectedErr,
+	}
+
+	b, err := json.Marshal(query)
 	assert.NoError(t, err)
 
-	p.api = &mockAPI{}
-	err = p.GarbageCollect(nil, metric, 0)
+	config := Config{
+		Query:   string(b),
+		Dataset: "test",
+		APIKey:  "secret",
+	}
+
+	configBytes, err := json.Marshal(config)
+	assert.NoError(t, err)
+
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result == 300",
+		FailureCondition: "result != 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: configBytes},
+		},
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, expectedErr.Error(), measurement.Message)
+	assert.NotNil(t, measurement.StartedAt)
+	assert.Equal(t, "", measurement.Value)
+	assert.NotNil(t, measurement.FinishedAt)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+}
+
+func TestRunWithResolveArgsError(t *testing.T) {
+	expectedErr := fmt.Errorf("failed to resolve {{args.var}}")
+	mock := &mockAPI{
+		err: expectedErr,
+	}
+
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result == 300",
+		FailureCondition: "result != 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","dataset":"test","apiKey":"secret"}`)},
+		},
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, expectedErr.Error(), measurement.Message)
+	assert.NotNil(t, measurement.StartedAt)
+	assert.Equal(t, "", measurement.Value)
+	assert.NotNil(t, measurement.FinishedAt)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+}
+
+func TestRunWithEvaluationError(t *testing.T) {
+	expectedErr := fmt.Errorf("no results returned")
+	query, queryResult := mockEmptyQueryResult()
+
+	mock := &mockAPI{
+		response: queryResult,
+		err:      expectedErr,
+	}
+
+	b, err := json.Marshal(query)
+	assert.NoError(t, err)
+
+	config := Config{
+		Query:   string(b),
+		Dataset: "test",
+		APIKey:  "secret",
+	}
+
+	configBytes, err := json.Marshal(config)
+	assert.NoError(t, err)
+
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result == 300",
+		FailureCondition: "result != 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: configBytes},
+		},
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, expectedErr.Error(), measurement.Message)
+	assert.NotNil(t, measurement.StartedAt)
+	assert.Equal(t, "", measurement.Value)
+	assert.NotNil(t, measurement.FinishedAt)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+}
+
+func TestRunRecordsLinksOnEvaluationError(t *testing.T) {
+	_, queryResult := mockEmptyQueryResult()
+	queryResult.Links.QueryURL = "https://ui.honeycomb.io/team/datasets/test/result/sGUnkBHgRFN"
+	queryResult.Links.GraphImageURL = "https://ui.honeycomb.io/team/datasets/test/result/sGUnkBHgRFN/snapshot"
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), newHoneycombMetric("foo", "bar"))
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "no results returned", measurement.Message)
+	assert.Equal(t, map[string]string{
+		HoneycombQueryID:       "query-1",
+		HoneycombQueryResultID: "result-1",
+		HoneycombQueryURL:      "https://ui.honeycomb.io/team/datasets/test/result/sGUnkBHgRFN",
+		HoneycombGraphImageURL: "https://ui.honeycomb.io/team/datasets/test/result/sGUnkBHgRFN/snapshot",
+	}, measurement.Metadata)
+}
+
+func TestRunAndResumeIncompleteQueryResult(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response:       queryResult,
+		pendingResults: 2,
+	}
+
+	metric := newHoneycombMetric("foo", "bar")
+	metric.SuccessCondition = "result < 300"
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, "result-1", measurement.Metadata[HoneycombQueryResultID])
+	assert.NotNil(t, measurement.StartedAt)
+	assert.NotNil(t, measurement.ResumeAt)
+	assert.Nil(t, measurement.FinishedAt)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.NotNil(t, measurement.ResumeAt)
+	assert.Nil(t, measurement.FinishedAt)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, `[210, 250]`, measurement.Value)
+	assert.Nil(t, measurement.ResumeAt)
+	assert.NotNil(t, measurement.FinishedAt)
+
+	assert.Equal(t, []string{"query-1"}, mock.queryIDs)
+	assert.Equal(t, []string{"result-1", "result-1"}, mock.queryResultIDs)
+}
+
+func TestResumeTimesOut(t *testing.T) {
+	mock := &mockAPI{
+		pendingResults: 1,
+	}
+	p := newTestProvider(mock)
+
+	startedAt := metav1.NewTime(time.Now().Add(-2 * queryResultTimeout))
+	previousMeasurement := v1alpha1.Measurement{
+		StartedAt: &startedAt,
+		Phase:     v1alpha1.AnalysisPhaseRunning,
+		Metadata:  map[string]string{HoneycombQueryResultID: "result-1"},
+	}
+
+	measurement := p.Resume(newAnalysisRun(), newHoneycombMetric("foo", "bar"), previousMeasurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "timed out waiting for query result", measurement.Message)
+	assert.NotNil(t, measurement.FinishedAt)
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		err      error
+		expected v1alpha1.AnalysisPhase
+		message  string
+	}{
+		{
+			name:     "without query result",
+			expected: v1alpha1.AnalysisPhaseError,
+			message:  "measurement has no honeycomb query result to resume",
+		},
+		{
+			name:     "with query error",
+			metadata: map[string]string{HoneycombQueryResultID: "result-1"},
+			err:      fmt.Errorf("not good"),
+			expected: v1alpha1.AnalysisPhaseError,
+			message:  "not good",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvider(&mockAPI{err: test.err})
+
+			now := metav1.Now()
+			previousMeasurement := v1alpha1.Measurement{
+				StartedAt: &now,
+				Phase:     v1alpha1.AnalysisPhaseRunning,
+				Metadata:  test.metadata,
+			}
+			measurement := p.Resume(newAnalysisRun(), newHoneycombMetric("foo", "bar"), previousMeasurement)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.NotNil(t, measurement.FinishedAt)
+		})
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result == 300",
+		FailureCondition: "result != 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","dataset":"test","apiKey":"secret"}`)},
+		},
+	}
+	mock := &mockAPI{}
+	p := newTestProvider(mock)
+
+	now := metav1.Now()
+	previousMeasurement := v1alpha1.Measurement{
+		StartedAt: &now,
+		ResumeAt:  &now,
+		Phase:     v1alpha1.AnalysisPhaseRunning,
+		Metadata:  map[string]string{HoneycombQueryResultID: "result-1"},
+	}
+	measurement := p.Terminate(newAnalysisRun(), metric, previousMeasurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.NotNil(t, measurement.FinishedAt)
+	assert.Nil(t, measurement.ResumeAt)
+	assert.Empty(t, mock.queryResultIDs)
+}
+
+func TestGarbageCollect(t *testing.T) {
+	metric := v1alpha1.Metric{
+		Name:             "foo",
+		SuccessCondition: "result == 300",
+		FailureCondition: "result != 300",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"query":"bar","dataset":"test","apiKey":"secret"}`)},
+		},
+	}
+	p := newTestProvider(&mockAPI{})
+	err := p.GarbageCollect(nil, metric, 0)
 	assert.Equal(t, err, pluginTypes.RpcError{})
 }
+
+func newSLOMetric(successCondition string, windows string) v1alpha1.Metric {
+	return v1alpha1.Metric{
+		Name:             "availability",
+		SuccessCondition: successCondition,
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(fmt.Sprintf(`{"dataset":"test","apiKey":"secret","slo":{"id":"slo1","burnRateWindows":%s}}`, windows))},
+		},
+	}
+}
+
+func TestRunWithSLO(t *testing.T) {
+	now := time.Now()
+	// a 30 day SLO burning its budget at 2x over the last hour and at 1x before
+	history := []SLOHistory{
+		{Timestamp: now.Add(-6 * time.Hour).Unix(), BudgetRemaining: 50 + 100.0/360 + 5*100.0/720},
+		{Timestamp: now.Add(-time.Hour).Unix(), BudgetRemaining: 50 + 100.0/360},
+		{Timestamp: now.Add(-30 * time.Minute).Unix(), BudgetRemaining: 50 + 100.0/720},
+	}
+
+	tests := []struct {
+		name      string
+		condition string
+		windows   string
+		history   []SLOHistory
+		expected  v1alpha1.AnalysisPhase
+		message   string
+	}{
+		{
+			name:      "budget remaining",
+			condition: "budgetRemaining > 25 && compliance >= 99.9",
+			windows:   "null",
+			history:   history,
+			expected:  v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "burn rate over the first window",
+			condition: "burnRate < 1.5",
+			windows:   `["1h","6h"]`,
+			history:   history,
+			expected:  v1alpha1.AnalysisPhaseFailed,
+		},
+		{
+			name:      "burn rate by window",
+			condition: `burnRates["6h"] < 1.5`,
+			windows:   `["1h","6h"]`,
+			history:   history,
+			expected:  v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:      "no history",
+			condition: "burnRate < 1.5",
+			windows:   `["5m"]`,
+			history:   history,
+			expected:  v1alpha1.AnalysisPhaseError,
+			message:   "no SLO history in the last 5m0s",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				slo:        &SLO{Name: "checkout availability", TimePeriodDays: 30, Compliance: 99.95, BudgetRemaining: 50},
+				sloHistory: test.history,
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), newSLOMetric(test.condition, test.windows))
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.NotNil(t, measurement.FinishedAt)
+			assert.Nil(t, measurement.ResumeAt)
+			assert.Equal(t, 0, mock.createdQueries)
+			if test.expected != v1alpha1.AnalysisPhaseError {
+				assert.Equal(t, "checkout availability", measurement.Metadata[HoneycombSLOName])
+				assert.Equal(t, "slo1", measurement.Metadata[HoneycombSLOID])
+			}
+		})
+	}
+}
+
+func TestRunWithSLORequestsLongestWindow(t *testing.T) {
+	mock := &mockAPI{
+		slo:        &SLO{TimePeriodDays: 30, Compliance: 99.95, BudgetRemaining: 50},
+		sloHistory: []SLOHistory{{Timestamp: time.Now().Add(-time.Hour).Unix(), BudgetRemaining: 50 + 100.0/360}},
+	}
+	p := newTestProvider(mock)
+
+	measurement := p.Run(newAnalysisRun(), newSLOMetric("", `["1h","6h"]`))
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.WithinDuration(t, time.Now().Add(-6*time.Hour), mock.sloHistoryStart, time.Minute)
+	assert.Equal(t, "budgetRemaining=50, compliance=99.95, burnRate(1h)=2.00, burnRate(6h)=2.00", measurement.Value)
+	assert.Equal(t, map[string]string{HoneycombSLOID: "slo1"}, p.GetMetadata(newSLOMetric("", "null")))
+}
+
+func newBurnRateMetric(successCondition string) v1alpha1.Metric {
+	return v1alpha1.Metric{
+		Name:             "error-budget",
+		SuccessCondition: successCondition,
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{
+				"dataset": "test",
+				"apiKey": "secret",
+				"burnRate": {
+					"filters": [{"column": "service.name", "op": "=", "value": "checkout"}],
+					"good": [{"column": "http.status_code", "op": "<", "value": 500}],
+					"target": 99.9,
+					"windows": [{"short": "5m", "long": "1h", "threshold": 14.4}, {"short": "30m", "long": "6h", "threshold": 6}]
+				}
+			}`)},
+		},
+	}
+}
+
+// burnRateResponses returns the COUNT of the queries of a burn rate metric, by time range and whether the query
+// counts the good events
+func burnRateResponses(total map[int]int, bad map[int]int) func(query string) *QueryResult {
+	return func(query string) *QueryResult {
+		var q Query
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			panic(err)
+		}
+		count := total[q.TimeRange]
+		if len(q.Filters) > 1 {
+			count -= bad[q.TimeRange]
+		}
+		return &QueryResult{
+			Query:    q,
+			Complete: true,
+			Data: QueryResultData{
+				Results: []ResultsDatum{{Data: map[string]interface{}{"COUNT": json.Number(strconv.Itoa(count))}}},
+			},
+		}
+	}
+}
+
+func TestRunWithBurnRate(t *testing.T) {
+	total := map[int]int{300: 1000, 3600: 10000, 1800: 5000, 21600: 60000}
+
+	tests := []struct {
+		name      string
+		condition string
+		total     map[int]int
+		bad       map[int]int
+		expected  v1alpha1.AnalysisPhase
+		value     string
+		message   string
+	}{
+		{
+			name:     "within budget",
+			total:    total,
+			bad:      map[int]int{300: 1, 3600: 10, 1800: 5, 21600: 60},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "burnRate(5m)=1.00, burnRate(1h)=1.00, burnRate(30m)=1.00, burnRate(6h)=1.00",
+		},
+		{
+			name:     "both windows of a pair exceed the threshold",
+			total:    total,
+			bad:      map[int]int{300: 20, 3600: 150, 1800: 5, 21600: 60},
+			expected: v1alpha1.AnalysisPhaseFailed,
+			value:    "burnRate(5m)=20.00, burnRate(1h)=15.00, burnRate(30m)=1.00, burnRate(6h)=1.00",
+			message:  "burn rates over 5m and 1h exceed 14.4",
+		},
+		{
+			name:     "only the short window exceeds the threshold",
+			total:    total,
+			bad:      map[int]int{300: 20, 3600: 20, 1800: 50, 21600: 60},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "burnRate(5m)=20.00, burnRate(1h)=2.00, burnRate(30m)=10.00, burnRate(6h)=1.00",
+		},
+		{
+			name:     "only the long window exceeds the threshold",
+			total:    total,
+			bad:      map[int]int{300: 0, 3600: 150, 1800: 5, 21600: 420},
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "burnRate(5m)=0.00, burnRate(1h)=15.00, burnRate(30m)=1.00, burnRate(6h)=7.00",
+		},
+		{
+			name:      "conditions on the burn rates",
+			condition: `burnRate < 10 && burnRates["6h"] < 2`,
+			total:     total,
+			bad:       map[int]int{300: 5, 3600: 20, 1800: 5, 21600: 180},
+			expected:  v1alpha1.AnalysisPhaseFailed,
+			value:     "burnRate(5m)=5.00, burnRate(1h)=2.00, burnRate(30m)=1.00, burnRate(6h)=3.00",
+		},
+		{
+			name:     "no events",
+			total:    map[int]int{3600: 10000, 1800: 5000, 21600: 60000},
+			bad:      map[int]int{},
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			message:  "no events in the 5m window",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				responseFor: burnRateResponses(test.total, test.bad),
+			}
+			p := newTestProvider(mock)
+
+			measurement := p.Run(newAnalysisRun(), newBurnRateMetric(test.condition))
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.value, measurement.Value)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, 8, mock.createdQueries)
+			assert.Equal(t, "query-2", measurement.Metadata["HoneycombQueryID.good.5m"])
+		})
+	}
+}
+
+func TestRunAndResumeBurnRate(t *testing.T) {
+	mock := &mockAPI{
+		pendingResults: 8,
+		responseFor:    burnRateResponses(map[int]int{300: 1000, 3600: 10000, 1800: 5000, 21600: 60000}, map[int]int{}),
+	}
+	p := newTestProvider(mock)
+	metric := newBurnRateMetric("")
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, "burnRate(5m)=0.00, burnRate(1h)=0.00, burnRate(30m)=0.00, burnRate(6h)=0.00", measurement.Value)
+	assert.Equal(t, "result-8", measurement.Metadata["HoneycombQueryResultID.good.6h"])
+	assert.Equal(t, `{"calculations":[{"op":"COUNT"}],"filters":[{"op":"=","column":"service.name","value":"checkout"},{"op":"\u003c","column":"http.status_code","value":500}],"filter_combination":"AND","time_range":300}`, p.GetMetadata(metric)["ResolvedHoneycombQuery.good.5m"])
+}
+
+func TestRunWithTriggers(t *testing.T) {
+	triggers := map[string]*Trigger{
+		"t1": {ID: "t1", Name: "High error rate", Threshold: TriggerThreshold{Op: ">", Value: 0.05}},
+		"t2": {ID: "t2", Name: "Slow checkout", Threshold: TriggerThreshold{Op: ">=", Value: 1500}},
+		"t3": {ID: "t3", Name: "Checkout errors", Triggered: true, Threshold: TriggerThreshold{Op: ">", Value: 100}},
+		"t5": {ID: "t5", Name: "Cart errors", Disabled: true, Triggered: true, Threshold: TriggerThreshold{Op: ">", Value: 10}},
+	}
+
+	tests := []struct {
+		name     string
+		triggers string
+		expected v1alpha1.AnalysisPhase
+		value    string
+		message  string
+		metadata map[string]string
+	}{
+		{
+			name:     "none triggered",
+			triggers: `["t1","t2"]`,
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "0",
+			metadata: map[string]string{
+				"HoneycombTriggerName.t1":      "High error rate",
+				"HoneycombTriggerThreshold.t1": "> 0.05",
+				"HoneycombTriggerName.t2":      "Slow checkout",
+				"HoneycombTriggerThreshold.t2": ">= 1500",
+			},
+		},
+		{
+			name:     "triggered",
+			triggers: `["t1","t3"]`,
+			expected: v1alpha1.AnalysisPhaseFailed,
+			value:    "1",
+			message:  "1 of 2 triggers triggered: Checkout errors (> 100)",
+			metadata: map[string]string{
+				"HoneycombTriggerName.t1":      "High error rate",
+				"HoneycombTriggerThreshold.t1": "> 0.05",
+				"HoneycombTriggerName.t3":      "Checkout errors",
+				"HoneycombTriggerThreshold.t3": "> 100",
+			},
+		},
+		{
+			name:     "disabled",
+			triggers: `["t1","t5"]`,
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+			value:    "0",
+			message:  "1 of 2 triggers disabled: Cart errors",
+			metadata: map[string]string{
+				"HoneycombTriggerName.t1":      "High error rate",
+				"HoneycombTriggerThreshold.t1": "> 0.05",
+				"HoneycombTriggerName.t5":      "Cart errors",
+				"HoneycombTriggerThreshold.t5": "> 10",
+				"HoneycombTriggerDisabled.t5":  "true",
+			},
+		},
+		{
+			name:     "triggered and disabled",
+			triggers: `["t3","t5"]`,
+			expected: v1alpha1.AnalysisPhaseFailed,
+			value:    "1",
+			message:  "1 of 2 triggers triggered: Checkout errors (> 100), 1 of 2 triggers disabled: Cart errors",
+			metadata: map[string]string{
+				"HoneycombTriggerName.t3":      "Checkout errors",
+				"HoneycombTriggerThreshold.t3": "> 100",
+				"HoneycombTriggerName.t5":      "Cart errors",
+				"HoneycombTriggerThreshold.t5": "> 10",
+				"HoneycombTriggerDisabled.t5":  "true",
+			},
+		},
+		{
+			name:     "every trigger disabled",
+			triggers: `["t5"]`,
+			expected: v1alpha1.AnalysisPhaseInconclusive,
+			value:    "0",
+			message:  "1 of 1 triggers disabled: Cart errors",
+			metadata: map[string]string{
+				"HoneycombTriggerName.t5":      "Cart errors",
+				"HoneycombTriggerThreshold.t5": "> 10",
+				"HoneycombTriggerDisabled.t5":  "true",
+			},
+		},
+		{
+			name:     "unknown trigger",
+			triggers: `["t1","t4"]`,
+			expected: v1alpha1.AnalysisPhaseError,
+			message:  "failed to get trigger t4: trigger not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &mockAPI{
+				triggers: triggers,
+			}
+			p := newTestProvider(mock)
+			metric := v1alpha1.Metric{
+				Name: "triggers",
+				Provider: v1alpha1.MetricProvider{
+					Plugin: map[string]json.RawMessage{PluginName: []byte(fmt.Sprintf(`{"dataset":"test","apiKey":"secret","triggers":%s}`, test.triggers))},
+				},
+			}
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.value, measurement.Value)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, test.metadata, measurement.Metadata)
+			assert.NotNil(t, measurement.FinishedAt)
+			assert.Equal(t, 0, mock.createdQueries)
+			assert.Empty(t, p.GetMetadata(metric))
+		})
+	}
+}
+
+func TestRunWithTriggersAndConditions(t *testing.T) {
+	mock := &mockAPI{}
+	p := newTestProvider(mock)
+	metric := v1alpha1.Metric{
+		Name:             "triggers",
+		SuccessCondition: "result == 0",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{PluginName: []byte(`{"dataset":"test","apiKey":"secret","triggers":["t1"]}`)},
+		},
+	}
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "invalid honeycomb plugin config: successCondition and failureCondition cannot be used with triggers", measurement.Message)
+}
+
+func newMarkerRun() *v1alpha1.AnalysisRun {
+	run := newRolloutAnalysisRun()
+	run.CreationTimestamp = metav1.NewTime(time.Unix(1700000000, 0))
+	run.Annotations = map[string]string{revisionAnnotation: "3"}
+	return run
+}
+
+func newMarkerProvider(mock *mockAPI) *HoneycombProvider {
+	p := newTestProvider(mock)
+	p.images = &replicaSetImageStore{clientset: fake.NewSimpleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "guestbook-6c54f8f7d5",
+			Namespace: "shop",
+			Labels:    map[string]string{v1alpha1.DefaultRolloutUniqueLabelKey: "6c54f8f7d5"},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "guestbook", Image: "guestbook:v3"}, {Name: "proxy", Image: "envoy:1.29"}},
+				},
+			},
+		},
+	})}
+	return p
+}
+
+func newMarkerMetric(name string, successCondition string, count int) v1alpha1.Metric {
+	metric := newHoneycombMetric(name, "bar")
+	metric.SuccessCondition = successCondition
+	metric.Interval = "1m"
+	metric.Count = ptr(intstr.FromInt(count))
+	metric.Provider.Plugin[PluginName] = []byte(`{"query":"bar","dataset":"test","apiKey":"secret","markers":{"dataset":"__all__"}}`)
+	return metric
+}
+
+// withMeasurement records the measurement in the status of the AnalysisRun like the controller does
+func withMeasurement(run *v1alpha1.AnalysisRun, metric string, measurement v1alpha1.Measurement) {
+	for i := range run.Status.MetricResults {
+		result := &run.Status.MetricResults[i]
+		if result.Name == metric {
+			result.Measurements = append(result.Measurements, measurement)
+			switch measurement.Phase {
+			case v1alpha1.AnalysisPhaseError:
+				result.Error++
+				result.ConsecutiveError++
+				return
+			case v1alpha1.AnalysisPhaseFailed:
+				result.Failed++
+			}
+			result.Count++
+			result.ConsecutiveError = 0
+			return
+		}
+	}
+	run.Status.MetricResults = append(run.Status.MetricResults, v1alpha1.MetricResult{Name: metric})
+	withMeasurement(run, metric, measurement)
+}
+
+func TestRunWithMarkers(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	latency := newMarkerMetric("latency", "result < 1000", 2)
+	errorRate := newMarkerMetric("errors", "result < 1000", 2)
+	run.Spec.Metrics = []v1alpha1.Metric{latency, errorRate}
+
+	measurement := p.Run(run, latency)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, "marker-1", measurement.Metadata[HoneycombMarkerID])
+	assert.Equal(t, []Marker{{ID: "marker-1", Type: "deploy", Message: "guestbook revision 3 (guestbook:v3, envoy:1.29) started", StartTime: 1700000000}}, mock.markers)
+	assert.Equal(t, "__all__", mock.markerDataset)
+	withMeasurement(run, latency.Name, measurement)
+
+	// every metric of the AnalysisRun shares the marker
+	measurement = p.Run(run, errorRate)
+	assert.Equal(t, "marker-1", measurement.Metadata[HoneycombMarkerID])
+	withMeasurement(run, errorRate.Name, measurement)
+	assert.Len(t, mock.markers, 1)
+	assert.Equal(t, 0, mock.markerUpdates)
+
+	// the marker stays open until every metric has a final verdict
+	measurement = p.Run(run, latency)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, 0, mock.markerUpdates)
+	withMeasurement(run, latency.Name, measurement)
+
+	measurement = p.Run(run, errorRate)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Len(t, mock.markers, 1)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) successful", mock.markers[0].Message)
+	assert.Equal(t, int64(1700000000), mock.markers[0].StartTime)
+	assert.WithinDuration(t, time.Now(), time.Unix(mock.markers[0].EndTime, 0), time.Minute)
+	withMeasurement(run, errorRate.Name, measurement)
+
+	// a closed marker is not updated again
+	measurement = p.Terminate(run, errorRate, measurement)
+	assert.Equal(t, "marker-1", measurement.Metadata[HoneycombMarkerID])
+	assert.Equal(t, 1, mock.markerUpdates)
+}
+
+func TestRunWithMarkersClosesWithTheVerdictOfTheRun(t *testing.T) {
+	mock := &mockAPI{
+		responseFor: func(query string) *QueryResult {
+			if query == "errors" {
+				return mockResults("P99(duration_ms)", json.Number("1200"))
+			}
+			_, queryResult := mockQueryResult()
+			return queryResult
+		},
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	latency := newMarkerMetric("latency", "result < 1000", 1)
+	// metrics without markers count towards the verdict too
+	errorRate := newHoneycombMetric("errors", "errors")
+	errorRate.SuccessCondition = "result < 1000"
+	run.Spec.Metrics = []v1alpha1.Metric{latency, errorRate}
+	// the status of metrics which completed before the plugin restarted is taken into account
+	availability := v1alpha1.Metric{Name: "availability"}
+	// the plugin is not called when the metrics of other providers complete, it does not wait for them
+	smoke := v1alpha1.Metric{Name: "smoke", Provider: v1alpha1.MetricProvider{Job: &v1alpha1.JobMetric{}}}
+	run.Spec.Metrics = append(run.Spec.Metrics, availability, smoke)
+	run.Status.MetricResults = []v1alpha1.MetricResult{{Name: availability.Name, Phase: v1alpha1.AnalysisPhaseSuccessful}}
+
+	measurement := p.Run(run, latency)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, 0, mock.markerUpdates)
+	withMeasurement(run, latency.Name, measurement)
+
+	measurement = p.Run(run, errorRate)
+	assert.Equal(t, v1alpha1.AnalysisPhaseFailed, measurement.Phase)
+	assert.NotContains(t, measurement.Metadata, HoneycombMarkerID)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) failed", mock.markers[0].Message)
+}
+
+func TestTerminateWithMarkersAfterFailure(t *testing.T) {
+	mock := &mockAPI{
+		pendingResults: 1,
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	latency := newMarkerMetric("latency", "result < 1000", 5)
+	run.Spec.Metrics = []v1alpha1.Metric{latency, {Name: "errors"}}
+
+	measurement := p.Run(run, latency)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+
+	// the AnalysisRun is terminated because another metric failed
+	run.Status.MetricResults = append(run.Status.MetricResults, v1alpha1.MetricResult{Name: "errors", Phase: v1alpha1.AnalysisPhaseFailed})
+	p.Terminate(run, latency, measurement)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) failed", mock.markers[0].Message)
+}
+
+func TestRunWithMarkersClosesOnFailure(t *testing.T) {
+	mock := &mockAPI{
+		response: mockResults("P99(duration_ms)", json.Number("1200")),
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	metric := newMarkerMetric("latency", "result < 1000", 5)
+
+	measurement := p.Run(run, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseFailed, measurement.Phase)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) failed", mock.markers[0].Message)
+}
+
+func TestRunWithMarkersRetriesErrors(t *testing.T) {
+	mock := &mockAPI{}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	// without a count or an interval, the metric is measured once
+	metric := newMarkerMetric("triggers", "", 0)
+	metric.Interval = ""
+	metric.Count = nil
+	metric.Provider.Plugin[PluginName] = []byte(`{"triggers":["t1"],"apiKey":"secret","markers":{}}`)
+
+	// measurements which errored are retried, the marker stays open
+	measurement := p.Run(run, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "marker-1", measurement.Metadata[HoneycombMarkerID])
+	assert.Equal(t, 0, mock.markerUpdates)
+	withMeasurement(run, metric.Name, measurement)
+
+	mock.triggers = map[string]*Trigger{"t1": {ID: "t1", Name: "High error rate"}}
+	measurement = p.Run(run, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Len(t, mock.markers, 1)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) successful", mock.markers[0].Message)
+}
+
+func TestMarkerRegistryLocksPerRun(t *testing.T) {
+	r := newMarkerRegistry()
+
+	// a marker being created for an AnalysisRun does not hold up the others
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = r.ensure("run-1", nil, func() (string, error) {
+			close(creating)
+			<-release
+			return "marker-1", nil
+		})
+	}()
+	<-creating
+	id, err := r.ensure("run-2", nil, func() (string, error) { return "marker-2", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "marker-2", id)
+	close(release)
+	<-done
+
+	// concurrent measurements of an AnalysisRun share its marker
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := r.ensure("run-3", nil, func() (string, error) {
+				created.Add(1)
+				return "marker-3", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "marker-3", id)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created.Load())
+}
+
+func TestMarkerRegistryForgetsClosedMarkers(t *testing.T) {
+	r := newMarkerRegistry()
+	run := newMarkerRun()
+	_, err := r.ensure(run.UID, nil, func() (string, error) { return "marker-1", nil })
+	assert.NoError(t, err)
+
+	id, _, status, ok := r.conclude(run, "latency", v1alpha1.AnalysisPhaseInconclusive, false)
+	assert.True(t, ok)
+	assert.Equal(t, "marker-1", id)
+	assert.Equal(t, "inconclusive", status)
+	_, _, _, ok = r.conclude(run, "latency", "", true)
+	assert.False(t, ok)
+
+	// closed markers are forgotten once other metrics can no longer close them
+	r.markers[run.UID].closedAt = time.Now().Add(-closedMarkerRetention - time.Second)
+	_, err = r.ensure("run-2", nil, func() (string, error) { return "marker-2", nil })
+	assert.NoError(t, err)
+	assert.NotContains(t, r.markers, run.UID)
+
+	r.forget("run-2")
+	assert.Empty(t, r.markers)
+}
+
+func TestGarbageCollectForgetsMarkers(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	metric := newMarkerMetric("latency", "result < 1000", 5)
+
+	p.Run(run, metric)
+	assert.Contains(t, p.markers.markers, run.UID)
+	// the controller garbage collects the measurements of running AnalysisRuns too
+	assert.Equal(t, pluginTypes.RpcError{}, p.GarbageCollect(run, metric, 10))
+	assert.Contains(t, p.markers.markers, run.UID)
+
+	run.Status.Phase = v1alpha1.AnalysisPhaseSuccessful
+	assert.Equal(t, pluginTypes.RpcError{}, p.GarbageCollect(run, metric, 10))
+	assert.NotContains(t, p.markers.markers, run.UID)
+}
+
+func TestGarbageCollectKeepsMarkersOfRunningRuns(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	latency := newMarkerMetric("latency", "result < 1000", 1)
+	errorRate := newHoneycombMetric("errors", "errors")
+	errorRate.SuccessCondition = "result < 1000"
+	errorRate.Interval = "1m"
+	errorRate.Count = ptr(intstr.FromInt(12))
+	run.Spec.Metrics = []v1alpha1.Metric{latency, errorRate}
+
+	measurement := p.Run(run, latency)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	withMeasurement(run, latency.Name, measurement)
+
+	for i := 0; i < 11; i++ {
+		measurement = p.Run(run, errorRate)
+		assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+		withMeasurement(run, errorRate.Name, measurement)
+	}
+	// the controller garbage collects measurements beyond its retention limit while the AnalysisRun is running
+	assert.Equal(t, pluginTypes.RpcError{}, p.GarbageCollect(run, errorRate, 10))
+	assert.Equal(t, 0, mock.markerUpdates)
+
+	p.Run(run, errorRate)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) successful", mock.markers[0].Message)
+}
+
+func TestTerminateWithMarkers(t *testing.T) {
+	mock := &mockAPI{
+		pendingResults: 1,
+	}
+	p := newMarkerProvider(mock)
+	run := newMarkerRun()
+	metric := newMarkerMetric("latency", "result < 1000", 5)
+
+	measurement := p.Run(run, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, 0, mock.markerUpdates)
+
+	measurement = p.Terminate(run, metric, measurement)
+	assert.Equal(t, 1, mock.markerUpdates)
+	assert.Equal(t, "guestbook revision 3 (guestbook:v3, envoy:1.29) terminated", mock.markers[0].Message)
+	assert.Equal(t, "marker-1", measurement.Metadata[HoneycombMarkerID])
+}
+
+func TestRunWithMarkersAfterRestart(t *testing.T) {
+	_, queryResult := mockQueryResult()
+	mock := &mockAPI{
+		response: queryResult,
+	}
+	run := newMarkerRun()
+	metric := newMarkerMetric("latency", "result < 1000", 5)
+	withMeasurement(run, metric.Name, v1alpha1.Measurement{
+		Phase:    v1alpha1.AnalysisPhaseSuccessful,
+		Metadata: map[string]string{HoneycombMarkerID: "marker-0"},
+	})
+
+	// a new provider has no marker registered for the AnalysisRun
+	measurement := newMarkerProvider(mock).Run(run, metric)
+	assert.Equal(t, "marker-0", measurement.Metadata[HoneycombMarkerID])
+	assert.Empty(t, mock.markers)
+}
+
+func TestRunWithMarkersIgnoresMarkerErrors(t *testing.T) {
+	mock := &mockAPI{
+		triggers: map[string]*Trigger{"t1": {ID: "t1", Name: "High error rate"}},
+	}
+	p := newMarkerProvider(mock)
+	metric := newMarkerMetric("triggers", "", 1)
+	metric.Provider.Plugin[PluginName] = []byte(`{"triggers":["t1"],"apiKey":"secret","markers":{}}`)
+	p.newAPI = func(apiKey string, baseURL string) (honeycombAPI, error) {
+		return &failingMarkerAPI{mock}, nil
+	}
+	measurement := p.Run(newMarkerRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.NotContains(t, measurement.Metadata, HoneycombMarkerID)
+}
+
+// failingMarkerAPI fails to create markers
+type failingMarkerAPI struct {
+	*mockAPI
+}
+
+func (m *failingMarkerAPI) CreateMarker(ctx context.Context, marker Marker, dataset string) (*Marker, error) {
+	return nil, fmt.Errorf("failed to create marker: forbidden")
+}
+
+func newSavedQueryMock() *mockAPI {
+	query, queryResult := mockQueryResult()
+	return &mockAPI{
+		response:     queryResult,
+		savedQueries: map[string]*Query{"q1": query},
+		annotations: []QueryAnnotation{
+			{ID: "a1", Name: "checkout latency", QueryID: "q1"},
+			{ID: "a2", Name: "checkout errors", QueryID: "q2"},
+			{ID: "a3", Name: "duplicated", QueryID: "q1"},
+			{ID: "a4", Name: "duplicated", QueryID: "q2"},
+		},
+	}
+}
+
+func TestRunWithSavedQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected v1alpha1.AnalysisPhase
+		message  string
+	}{
+		{
+			name:     "query id",
+			config:   `{"queryID":"q1","dataset":"test","apiKey":"secret"}`,
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:     "query annotation",
+			config:   `{"queryAnnotation":"checkout latency","dataset":"test","apiKey":"secret"}`,
+			expected: v1alpha1.AnalysisPhaseSuccessful,
+		},
+		{
+			name:     "unknown query annotation",
+			config:   `{"queryAnnotation":"checkout saturation","dataset":"test","apiKey":"secret"}`,
+			expected: v1alpha1.AnalysisPhaseError,
+			message:  `query annotation "checkout saturation" not found`,
+		},
+		{
+			name:     "ambiguous query annotation",
+			config:   `{"queryAnnotation":"duplicated","dataset":"test","apiKey":"secret"}`,
+			expected: v1alpha1.AnalysisPhaseError,
+			message:  `more than one query annotation is named "duplicated"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newSavedQueryMock()
+			p := newTestProvider(mock)
+			metric := newHoneycombMetric("latency", "bar")
+			metric.SuccessCondition = "result < 1000"
+			metric.Provider.Plugin[PluginName] = []byte(test.config)
+
+			measurement := p.Run(newAnalysisRun(), metric)
+			assert.Equal(t, test.expected, measurement.Phase)
+			assert.Equal(t, test.message, measurement.Message)
+			assert.Equal(t, 0, mock.createdQueries)
+			if test.expected == v1alpha1.AnalysisPhaseError {
+				assert.Empty(t, mock.queryIDs)
+				assert.Empty(t, p.GetMetadata(metric))
+				return
+			}
+
+			assert.Equal(t, []string{"q1"}, mock.queryIDs)
+			assert.Equal(t, "q1", measurement.Metadata[HoneycombQueryID])
+			assert.Equal(t, "result-1", measurement.Metadata[HoneycombQueryResultID])
+			assert.Equal(t, map[string]string{
+				HoneycombQueryID:       "q1",
+				ResolvedHoneycombQuery: `{"breakdowns":["user_agent"],"calculations":[{"op":"P99","column":"duration_ms"}]}`,
+			}, p.GetMetadata(metric))
+		})
+	}
+}
+
+func TestRunAndResumeSavedQuery(t *testing.T) {
+	mock := newSavedQueryMock()
+	mock.pendingResults = 1
+	p := newTestProvider(mock)
+	metric := newHoneycombMetric("latency", "bar")
+	metric.Provider.Plugin[PluginName] = []byte(`{"queryAnnotation":"checkout latency","dataset":"test","apiKey":"secret"}`)
+
+	measurement := p.Run(newAnalysisRun(), metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+
+	measurement = p.Resume(newAnalysisRun(), metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, measurement.Phase)
+	assert.Equal(t, []string{"result-1"}, mock.queryResultIDs)
+	assert.Equal(t, 0, mock.createdQueries)
+}
@@ -0,0 +1,278 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// countOp is the calculation counting the events matching a query
+const countOp = "COUNT"
+
+// calculationOps are the calculations honeycomb supports, by whether they need a column
+var calculationOps = map[string]bool{
+	"COUNT":          false,
+	"CONCURRENCY":    false,
+	"SUM":            true,
+	"AVG":            true,
+	"COUNT_DISTINCT": true,
+	"MAX":            true,
+	"MIN":            true,
+	"P001":           true,
+	"P01":            true,
+	"P05":            true,
+	"P10":            true,
+	"P20":            true,
+	"P25":            true,
+	"P50":            true,
+	"P75":            true,
+	"P80":            true,
+	"P90":            true,
+	"P95":            true,
+	"P99":            true,
+	"P999":           true,
+	"HEATMAP":        true,
+	"RATE_AVG":       true,
+	"RATE_SUM":       true,
+	"RATE_MAX":       true,
+}
+
+// filterOps are the filters honeycomb supports, by whether they need a value
+var filterOps = map[string]bool{
+	"=":                   true,
+	"!=":                  true,
+	">":                   true,
+	">=":                  true,
+	"<":                   true,
+	"<=":                  true,
+	"starts-with":         true,
+	"does-not-start-with": true,
+	"ends-with":           true,
+	"does-not-end-with":   true,
+	"contains":            true,
+	"does-not-contain":    true,
+	"in":                  true,
+	"not-in":              true,
+	"exists":              false,
+	"does-not-exist":      false,
+}
+
+var havingOps = []string{"=", "!=", ">", ">=", "<", "<="}
+
+var filterCombinations = []string{"", "AND", "OR"}
+
+var orderDirections = []string{"", "ascending", "descending"}
+
+// validateQuery checks a query specification for mistakes honeycomb would otherwise only report when the query is
+// created at rollout time
+func validateQuery(q *Query) error {
+	if len(q.Calculations) == 0 {
+		return errors.New("at least one calculation must be specified")
+	}
+
+	for i, calculation := range q.Calculations {
+		if err := validateCalculation(calculation.Op, calculation.Column); err != nil {
+			return fmt.Errorf("calculations[%d]: %w", i, err)
+		}
+	}
+
+	for i, breakdown := range q.Breakdowns {
+		if breakdown == "" {
+			return fmt.Errorf("breakdowns[%d]: column must be specified", i)
+		}
+	}
+
+	for i, filter := range q.Filters {
+		if err := validateFilter(filter); err != nil {
+			return fmt.Errorf("filters[%d]: %w", i, err)
+		}
+	}
+
+	if !slices.Contains(filterCombinations, q.FilterCombo) {
+		return fmt.Errorf("filter_combination must be AND or OR, got %q", q.FilterCombo)
+	}
+
+	for i, order := range q.Orders {
+		if err := validateOrder(q, order); err != nil {
+			return fmt.Errorf("orders[%d]: %w", i, err)
+		}
+	}
+
+	for i, having := range q.Havings {
+		if err := validateCalculation(having.CalculateOp, having.Column); err != nil {
+			return fmt.Errorf("havings[%d]: %w", i, err)
+		}
+		if !slices.Contains(havingOps, having.Op) {
+			return fmt.Errorf("havings[%d]: unknown op %q", i, having.Op)
+		}
+	}
+
+	for i, field := range q.CalculatedFields {
+		if err := validateCalculatedField(field); err != nil {
+			return fmt.Errorf("calculated_fields[%d]: %w", i, err)
+		}
+	}
+	if err := validateCalculatedFields(q.CalculatedFields, q.Calculations); err != nil {
+		return err
+	}
+
+	if err := validateCompareTimeOffset(q.CompareTimeOffsetSeconds); err != nil {
+		return err
+	}
+
+	if q.TimeRange < 0 || q.Granularity < 0 || q.Limit < 0 || q.StartTime < 0 || q.EndTime < 0 {
+		return errors.New("time_range, granularity, limit, start_time and end_time cannot be negative")
+	}
+
+	return nil
+}
+
+func validateCalculation(op string, column *string) error {
+	needsColumn, ok := calculationOps[op]
+	if !ok {
+		return fmt.Errorf("unknown op %q", op)
+	}
+	hasColumn := column != nil && *column != ""
+	if needsColumn && !hasColumn {
+		return fmt.Errorf("%s requires a column", op)
+	}
+	if !needsColumn && hasColumn {
+		return fmt.Errorf("%s does not take a column", op)
+	}
+	return nil
+}
+
+func validateFilter(filter Filter) error {
+	needsValue, ok := filterOps[filter.Op]
+	if !ok {
+		return fmt.Errorf("unknown op %q", filter.Op)
+	}
+	if filter.Column == nil || *filter.Column == "" {
+		return errors.New("column must be specified")
+	}
+	if needsValue && filter.Value == nil {
+		return fmt.Errorf("%s requires a value", filter.Op)
+	}
+	if !needsValue && filter.Value != nil {
+		return fmt.Errorf("%s does not take a value", filter.Op)
+	}
+	if filter.Op == "in" || filter.Op == "not-in" {
+		if _, ok := filter.Value.([]interface{}); !ok {
+			return fmt.Errorf("%s requires a list of values", filter.Op)
+		}
+	}
+	return nil
+}
+
+func validateOrder(q *Query, order Order) error {
+	if !slices.Contains(orderDirections, order.Order) {
+		return fmt.Errorf("order must be ascending or descending, got %q", order.Order)
+	}
+	if order.Op == "" {
+		// ordering by a breakdown
+		if order.Column == "" {
+			return errors.New("column or op must be specified")
+		}
+		return nil
+	}
+
+	var column *string
+	if order.Column != "" {
+		column = &order.Column
+	}
+	if err := validateCalculation(order.Op, column); err != nil {
+		return err
+	}
+	name := calculationName(Calculation{Op: order.Op, Column: column})
+	for _, calculation := range q.Calculations {
+		if calculationName(calculation) == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a calculation of the query", name)
+}
+
+func validateCalculatedField(field CalculatedField) error {
+	if field.Name == "" {
+		return errors.New("name must be specified")
+	}
+	if field.Expression == "" {
+		return errors.New("expression must be specified")
+	}
+	return nil
+}
+
+// validateCalculatedFields checks that the names of the calculated fields of a query are unique and do not clash
+// with the names of its calculations, which key the results of the query
+func validateCalculatedFields(fields []CalculatedField, calculations []Calculation) error {
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if names[field.Name] {
+			return fmt.Errorf("calculated field %s is defined more than once", field.Name)
+		}
+		names[field.Name] = true
+	}
+	for _, calculation := range calculations {
+		if name := calculationName(calculation); names[name] {
+			return fmt.Errorf("calculated field %s clashes with a calculation of the query", name)
+		}
+	}
+	return nil
+}
+
+// withCalculatedFields adds calculated fields to a raw honeycomb query
+func withCalculatedFields(query string, fields []CalculatedField) (string, error) {
+	var spec Query
+	if err := json.Unmarshal([]byte(query), &spec); err != nil {
+		return "", fmt.Errorf("failed to parse query: %w", err)
+	}
+	if err := validateCalculatedFields(append(spec.CalculatedFields, fields...), spec.Calculations); err != nil {
+		return "", err
+	}
+
+	return updateQuery(query, func(q map[string]interface{}) error {
+		existing, _ := q["calculated_fields"].([]interface{})
+		for _, field := range fields {
+			existing = append(existing, field)
+		}
+		q["calculated_fields"] = existing
+		return nil
+	})
+}
+
+// withCount adds a COUNT calculation to a raw honeycomb query which does not have one
+func withCount(query string) (string, error) {
+	return updateQuery(query, func(q map[string]interface{}) error {
+		calculations, _ := q["calculations"].([]interface{})
+		for _, calculation := range calculations {
+			c, _ := calculation.(map[string]interface{})
+			if c["op"] == countOp && c["column"] == nil {
+				return nil
+			}
+		}
+		q["calculations"] = append(calculations, Calculation{Op: countOp})
+		return nil
+	})
+}
+
+// updateQuery updates a raw honeycomb query. Members of the query the plugin does not know about are kept.
+func updateQuery(query string, update func(q map[string]interface{}) error) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(query))
+	decoder.UseNumber()
+	var q map[string]interface{}
+	if err := decoder.Decode(&q); err != nil {
+		return "", fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	if err := update(q); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:  "valid query",
+			query: `{"calculations":[{"op":"COUNT"},{"op":"P99","column":"duration_ms"}],"breakdowns":["service.name"],"filters":[{"column":"http.status_code","op":"in","value":[500,503]}],"filter_combination":"OR","orders":[{"column":"service.name"},{"op":"COUNT","order":"descending"}],"havings":[{"calculate_op":"COUNT","op":">","value":10}],"time_range":600}`,
+		},
+		{
+			name:     "no calculations",
+			query:    `{"time_range":600}`,
+			expected: "at least one calculation must be specified",
+		},
+		{
+			name:     "unknown calculation",
+			query:    `{"calculations":[{"op":"MEDIAN","column":"duration_ms"}]}`,
+			expected: `calculations[0]: unknown op "MEDIAN"`,
+		},
+		{
+			name:     "calculation without column",
+			query:    `{"calculations":[{"op":"COUNT"},{"op":"AVG"}]}`,
+			expected: "calculations[1]: AVG requires a column",
+		},
+		{
+			name:     "count with column",
+			query:    `{"calculations":[{"op":"COUNT","column":"duration_ms"}]}`,
+			expected: "calculations[0]: COUNT does not take a column",
+		},
+		{
+			name:     "empty breakdown",
+			query:    `{"calculations":[{"op":"COUNT"}],"breakdowns":[""]}`,
+			expected: "breakdowns[0]: column must be specified",
+		},
+		{
+			name:     "unknown filter",
+			query:    `{"calculations":[{"op":"COUNT"}],"filters":[{"column":"name","op":"like","value":"foo"}]}`,
+			expected: `filters[0]: unknown op "like"`,
+		},
+		{
+			name:     "filter without column",
+			query:    `{"calculations":[{"op":"COUNT"}],"filters":[{"op":"=","value":"foo"}]}`,
+			expected: "filters[0]: column must be specified",
+		},
+		{
+			name:     "filter without value",
+			query:    `{"calculations":[{"op":"COUNT"}],"filters":[{"column":"name","op":"="}]}`,
+			expected: "filters[0]: = requires a value",
+		},
+		{
+			name:     "exists filter with value",
+			query:    `{"calculations":[{"op":"COUNT"}],"filters":[{"column":"name","op":"exists","value":"foo"}]}`,
+			expected: "filters[0]: exists does not take a value",
+		},
+		{
+			name:     "in filter without list",
+			query:    `{"calculations":[{"op":"COUNT"}],"filters":[{"column":"name","op":"in","value":"foo"}]}`,
+			expected: "filters[0]: in requires a list of values",
+		},
+		{
+			name:     "unknown filter combination",
+			query:    `{"calculations":[{"op":"COUNT"}],"filter_combination":"XOR"}`,
+			expected: `filter_combination must be AND or OR, got "XOR"`,
+		},
+		{
+			name:     "order by unknown calculation",
+			query:    `{"calculations":[{"op":"COUNT"}],"orders":[{"op":"P99","column":"duration_ms"}]}`,
+			expected: "orders[0]: P99(duration_ms) is not a calculation of the query",
+		},
+		{
+			name:     "unknown order direction",
+			query:    `{"calculations":[{"op":"COUNT"}],"orders":[{"op":"COUNT","order":"up"}]}`,
+			expected: `orders[0]: order must be ascending or descending, got "up"`,
+		},
+		{
+			name:     "unknown having op",
+			query:    `{"calculations":[{"op":"COUNT"}],"havings":[{"calculate_op":"COUNT","op":"~","value":1}]}`,
+			expected: `havings[0]: unknown op "~"`,
+		},
+		{
+			name:     "negative time range",
+			query:    `{"calculations":[{"op":"COUNT"}],"time_range":-60}`,
+			expected: "time_range, granularity, limit, start_time and end_time cannot be negative",
+		},
+		{
+			name:     "calculated field without expression",
+			query:    `{"calculations":[{"op":"COUNT"}],"calculated_fields":[{"name":"is_error"}]}`,
+			expected: "calculated_fields[0]: expression must be specified",
+		},
+		{
+			name:     "calculated field defined twice",
+			query:    `{"calculations":[{"op":"COUNT"}],"calculated_fields":[{"name":"is_error","expression":"1"},{"name":"is_error","expression":"0"}]}`,
+			expected: "calculated field is_error is defined more than once",
+		},
+		{
+			name:     "calculated field clashing with a calculation",
+			query:    `{"calculations":[{"op":"COUNT"}],"calculated_fields":[{"name":"COUNT","expression":"1"}]}`,
+			expected: "calculated field COUNT clashes with a calculation of the query",
+		},
+		{
+			name:     "unsupported compare time offset",
+			query:    `{"calculations":[{"op":"COUNT"}],"compare_time_offset_seconds":600}`,
+			expected: "compare_time_offset_seconds must be one of [1800 3600 7200 28800 86400 604800 2419200 15724800], got 600",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var q Query
+			assert.NoError(t, json.Unmarshal([]byte(test.query), &q))
+
+			err := validateQuery(&q)
+			if test.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expected)
+			}
+		})
+	}
+}
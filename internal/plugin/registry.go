@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// queryKey identifies the honeycomb query created for a metric of an AnalysisRun
+type queryKey struct {
+	runUID types.UID
+	metric string
+	// role tells apart the queries of a metric which runs several queries per measurement
+	role      string
+	queryHash string
+}
+
+// queryRegistry keeps track of the honeycomb queries created for every metric of every AnalysisRun, so that
+// each measurement of a metric reuses its own query instead of creating a new one. The queries of a metric are
+// forgotten by its final measurement, when it is terminated, or when it is garbage collected once the AnalysisRun
+// completed; garbage collection alone would leave the queries of most metrics behind, since it only happens to
+// metrics with many measurements.
+type queryRegistry struct {
+	mu      sync.Mutex
+	queries map[queryKey]string
+}
+
+func newQueryRegistry() *queryRegistry {
+	return &queryRegistry{
+		queries: make(map[queryKey]string),
+	}
+}
+
+// hashQuery returns a stable hash of a query and the dataset it runs against
+func hashQuery(query string, dataset string) string {
+	h := sha256.New()
+	h.Write([]byte(dataset))
+	h.Write([]byte{0})
+	h.Write([]byte(query))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the ID of the query previously created for the metric of the AnalysisRun, if the query text is unchanged
+func (r *queryRegistry) get(runUID types.UID, metric string, role string, queryHash string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queryID, ok := r.queries[queryKey{runUID: runUID, metric: metric, role: role, queryHash: queryHash}]
+	return queryID, ok
+}
+
+// set records the ID of the query created for the metric of the AnalysisRun. Queries previously recorded for the
+// same metric and role with a different query text are invalidated.
+func (r *queryRegistry) set(runUID types.UID, metric string, role string, queryHash string, queryID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.queries {
+		if key.runUID == runUID && key.metric == metric && key.role == role {
+			delete(r.queries, key)
+		}
+	}
+	r.queries[queryKey{runUID: runUID, metric: metric, role: role, queryHash: queryHash}] = queryID
+}
+
+// forget removes every query recorded for the metric of the AnalysisRun, whatever its role
+func (r *queryRegistry) forget(runUID types.UID, metric string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.queries {
+		if key.runUID == runUID && key.metric == metric {
+			delete(r.queries, key)
+		}
+	}
+}
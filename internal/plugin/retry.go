@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultMaxAttempts is how many times a request to the honeycomb API is attempted
+	defaultMaxAttempts = 4
+	// defaultBaseDelay is the delay before the first retry, doubled on every further retry
+	defaultBaseDelay = 250 * time.Millisecond
+	// defaultMaxDelay caps the delay between two attempts
+	defaultMaxDelay = 4 * time.Second
+)
+
+// RetryError is returned when a request to the honeycomb API still fails after being retried
+type RetryError struct {
+	// Attempts is the number of times the request was sent
+	Attempts int
+	// StatusCode is the status code of the last response, or 0 when the last attempt failed without a response
+	StatusCode int
+	// Err is the error of the last attempt, if any
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	msg := fmt.Sprintf("honeycomb API request failed after %d attempts", e.Attempts)
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s, last status code %d", msg, e.StatusCode)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// notIdempotentKey is the context key of requests which must not be sent twice
+type notIdempotentKey struct{}
+
+// notIdempotent marks the requests sent with the context as not safe to send twice, e.g. creating a marker. They are
+// only retried when rate limited, since honeycomb did not process them then.
+func notIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, notIdempotentKey{}, true)
+}
+
+// retryTransport retries requests which fail with a network error, a 429 or a 5xx response. The Retry-After header
+// of 429 responses is honoured, other failures are retried with a bounded exponential backoff with jitter. Retries
+// stop as soon as the next attempt could not complete before the deadline of the request context. Requests which are
+// not idempotent are only retried on 429 responses.
+type retryTransport struct {
+	next        http.RoundTripper
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+var _ http.RoundTripper = &retryTransport{}
+
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		next:        next,
+		maxAttempts: defaultMaxAttempts,
+		baseDelay:   defaultBaseDelay,
+		maxDelay:    defaultMaxDelay,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, &RetryError{Attempts: attempt - 1, Err: fmt.Errorf("request body cannot be replayed")}
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, &RetryError{Attempts: attempt - 1, Err: err}
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+		if ctx.Err() != nil {
+			// the caller gave up, there is no point in retrying
+			return resp, err
+		}
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if ctx.Value(notIdempotentKey{}) != nil && (err != nil || resp.StatusCode != http.StatusTooManyRequests) {
+			// the request may have been processed, sending it again could apply it twice
+			return resp, err
+		}
+
+		retryErr := &RetryError{Attempts: attempt, Err: err}
+		delay := t.backoff(attempt)
+		if resp != nil {
+			retryErr.StatusCode = resp.StatusCode
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && resp.StatusCode == http.StatusTooManyRequests {
+				delay = retryAfter
+			}
+			// the connection can only be reused once the body has been read
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if attempt >= t.maxAttempts {
+			return nil, retryErr
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, retryErr
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			retryErr.Err = ctx.Err()
+			return nil, retryErr
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the attempt following the given one, with full jitter over its upper half
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.baseDelay << (attempt - 1)
+	if delay > t.maxDelay || delay <= 0 {
+		delay = t.maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRetryClient() *http.Client {
+	tr := newRetryTransport(http.DefaultTransport)
+	tr.baseDelay = time.Millisecond
+	tr.maxDelay = 5 * time.Millisecond
+	return &http.Client{Transport: tr}
+}
+
+// newFlakyServer returns a server which responds with the given responses in turn, then with 200
+func newFlakyServer(t *testing.T, responses ...func(w http.ResponseWriter)) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"query_id":"q1"}`, string(body))
+
+		n := int(requests.Add(1))
+		if n <= len(responses) {
+			responses[n-1](w)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"r1"}`))
+	}))
+	return server, &requests
+}
+
+func status(code int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(code)
+	}
+}
+
+func post(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(`{"query_id":"q1"}`))
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func TestRetryTransportRetriesServerErrors(t *testing.T) {
+	server, requests := newFlakyServer(t, status(http.StatusBadGateway), status(http.StatusServiceUnavailable))
+	defer server.Close()
+
+	resp, err := post(context.Background(), newTestRetryClient(), server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestRetryTransportHonoursRetryAfter(t *testing.T) {
+	server, requests := newFlakyServer(t, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := post(context.Background(), newTestRetryClient(), server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	server, requests := newFlakyServer(t,
+		status(http.StatusInternalServerError),
+		status(http.StatusInternalServerError),
+		status(http.StatusInternalServerError),
+		status(http.StatusServiceUnavailable),
+	)
+	defer server.Close()
+
+	_, err := post(context.Background(), newTestRetryClient(), server.URL)
+	var retryErr *RetryError
+	assert.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, defaultMaxAttempts, retryErr.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, retryErr.StatusCode)
+	assert.Equal(t, int32(defaultMaxAttempts), requests.Load())
+}
+
+func TestRetryTransportRespectsDeadline(t *testing.T) {
+	server, requests := newFlakyServer(t, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := post(ctx, newTestRetryClient(), server.URL)
+	assert.Less(t, time.Since(start), time.Second)
+
+	var retryErr *RetryError
+	assert.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 1, retryErr.Attempts)
+	assert.Equal(t, http.StatusTooManyRequests, retryErr.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestRetryTransportDoesNotRetryClientErrors(t *testing.T) {
+	server, requests := newFlakyServer(t, status(http.StatusBadRequest))
+	defer server.Close()
+
+	resp, err := post(context.Background(), newTestRetryClient(), server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestRetryTransportDoesNotRetryNotIdempotentRequests(t *testing.T) {
+	server, requests := newFlakyServer(t, status(http.StatusServiceUnavailable))
+	defer server.Close()
+
+	resp, err := post(notIdempotent(context.Background()), newTestRetryClient(), server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// rate limited requests were not processed
+	server, requests = newFlakyServer(t, status(http.StatusTooManyRequests))
+	defer server.Close()
+
+	resp, err = post(notIdempotent(context.Background()), newTestRetryClient(), server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestRetryTransportRetriesNetworkErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := post(context.Background(), newTestRetryClient(), url)
+	var retryErr *RetryError
+	assert.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, defaultMaxAttempts, retryErr.Attempts)
+	assert.Equal(t, 0, retryErr.StatusCode)
+	assert.Error(t, retryErr.Err)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	delay, ok := parseRetryAfter("5")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, delay)
+
+	delay, ok = parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	metricutil "github.com/argoproj/argo-rollouts/utils/metric"
+)
+
+// savedQuery returns whether the config references a query saved in honeycomb instead of defining one
+func (c *Config) savedQuery() bool {
+	return c.QueryID != "" || c.QueryAnnotation != ""
+}
+
+// resolveSavedQuery returns the ID of the saved query of the config, looking up the query annotation by name when
+// the config references one
+func resolveSavedQuery(ctx context.Context, api honeycombAPI, config *Config) (string, error) {
+	if config.QueryID != "" {
+		return config.QueryID, nil
+	}
+
+	annotations, err := api.ListQueryAnnotations(ctx, config.Dataset)
+	if err != nil {
+		return "", err
+	}
+
+	var queryID string
+	for _, annotation := range annotations {
+		if annotation.Name != config.QueryAnnotation {
+			continue
+		}
+		if queryID != "" {
+			return "", fmt.Errorf("more than one query annotation is named %q", config.QueryAnnotation)
+		}
+		queryID = annotation.QueryID
+	}
+	if queryID == "" {
+		return "", fmt.Errorf("query annotation %q not found", config.QueryAnnotation)
+	}
+	return queryID, nil
+}
+
+// savedQuerySpec returns the ID and the specification of the saved query of the config
+func (p *HoneycombProvider) savedQuerySpec(config *Config) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	api, err := p.newConfiguredAPI(ctx, config)
+	if err != nil {
+		return "", "", err
+	}
+
+	queryID, err := resolveSavedQuery(ctx, api, config)
+	if err != nil {
+		return "", "", err
+	}
+
+	query, err := api.GetQuery(ctx, queryID, config.Dataset)
+	if err != nil {
+		return "", "", err
+	}
+	// the ID is reported on its own
+	query.ID = ""
+	b, err := json.Marshal(query)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal query: %w", err)
+	}
+	return queryID, string(b), nil
+}
+
+// runSavedQuery starts running the saved query of the config as it is, without creating a query
+func (p *HoneycombProvider) runSavedQuery(metric v1alpha1.Metric, config *Config, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	api, err := p.newConfiguredAPI(ctx, config)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	queryID, err := resolveSavedQuery(ctx, api, config)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	queryResult, err := api.CreateQueryResult(ctx, queryID, config.Dataset)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	measurement.Metadata = map[string]string{
+		HoneycombQueryID:       queryID,
+		HoneycombQueryResultID: queryResult.ID,
+	}
+
+	return p.processQueryResults(metric, config, measurement, map[string]*QueryResult{"": queryResult})
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apiKeyStore looks up honeycomb API keys stored in Kubernetes secrets
+type apiKeyStore interface {
+	APIKey(ctx context.Context, name string, key string) (string, error)
+}
+
+// secretStore serves API keys from a watched cache of the secrets in the argo-rollouts namespace, so rotated keys
+// are picked up without restarting the controller.
+type secretStore struct {
+	namespace string
+	clientset kubernetes.Interface
+	lister    corev1listers.SecretNamespaceLister
+	hasSynced cache.InformerSynced
+}
+
+var _ apiKeyStore = &secretStore{}
+
+// newKubernetesClientset returns a clientset for the cluster the plugin runs in, falling back to the local kubeconfig
+func newKubernetesClientset() (kubernetes.Interface, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes config: %w", err)
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// newSecretStore starts watching the secrets of the namespace until the context is done
+func newSecretStore(ctx context.Context, clientset kubernetes.Interface, namespace string) *secretStore {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	secrets := factory.Core().V1().Secrets()
+	lister := secrets.Lister().Secrets(namespace)
+	informer := secrets.Informer()
+	factory.Start(ctx.Done())
+
+	return &secretStore{
+		namespace: namespace,
+		clientset: clientset,
+		lister:    lister,
+		hasSynced: informer.HasSynced,
+	}
+}
+
+// APIKey returns the value of the key in the named secret
+func (s *secretStore) APIKey(ctx context.Context, name string, key string) (string, error) {
+	var secret *corev1.Secret
+	var err error
+	if s.hasSynced() {
+		secret, err = s.lister.Get(name)
+	} else {
+		// the watch has not caught up yet, read the secret directly
+		secret, err = s.clientset.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if k8serrors.IsNotFound(err) {
+		return "", fmt.Errorf("secret %s/%s not found", s.namespace, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s/%s: %w", s.namespace, name, err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok || len(value) == 0 {
+		return "", fmt.Errorf("secret %s/%s has no %q key", s.namespace, name, key)
+	}
+
+	return string(value), nil
+}
+
+// unavailableSecretStore is used when the plugin cannot reach the Kubernetes API
+type unavailableSecretStore struct {
+	err error
+}
+
+func (s unavailableSecretStore) APIKey(ctx context.Context, name string, key string) (string, error) {
+	return "", fmt.Errorf("kubernetes secrets are unavailable, set apiKey instead: %w", s.err)
+}
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/expr-lang/expr"
+)
+
+// seriesPoint is the value of a calculation in one bucket of the series of a query result
+type seriesPoint struct {
+	Time  time.Time `expr:"time"`
+	Value float64   `expr:"value"`
+}
+
+// groupSeries returns the series of the calculation of every group of a query result, ordered by time. Buckets
+// without a value are left out.
+func groupSeries(result *QueryResult, name string) (map[string][]seriesPoint, error) {
+	series := make(map[string][]seriesPoint)
+	for _, datum := range result.Data.Series {
+		data, ok := datum.Data.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected series data %v of type %T", datum.Data, datum.Data)
+		}
+		value, ok, err := calculationValue(data[name])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, datum.Time)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse series time %q: %w", datum.Time, err)
+		}
+		label := groupLabel(result.Query.Breakdowns, data)
+		series[label] = append(series[label], seriesPoint{Time: t, Value: value})
+	}
+
+	for _, points := range series {
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	}
+	return series, nil
+}
+
+// seriesValues returns the values of the series
+func seriesValues(series []seriesPoint) []float64 {
+	values := make([]float64, len(series))
+	for i, point := range series {
+		values[i] = point.Value
+	}
+	return values
+}
+
+func seriesMax(series []seriesPoint) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	result := series[0].Value
+	for _, point := range series[1:] {
+		result = max(result, point.Value)
+	}
+	return result
+}
+
+func seriesMin(series []seriesPoint) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	result := series[0].Value
+	for _, point := range series[1:] {
+		result = min(result, point.Value)
+	}
+	return result
+}
+
+func seriesAvg(series []seriesPoint) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, point := range series {
+		sum += point.Value
+	}
+	return sum / float64(len(series))
+}
+
+func seriesLast(series []seriesPoint) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	return series[len(series)-1].Value
+}
+
+// seriesSlope returns the slope of the least squares line through the series, in units per second
+func seriesSlope(series []seriesPoint) float64 {
+	if len(series) < 2 {
+		return 0
+	}
+	start := series[0].Time
+	var meanX, meanY float64
+	for _, point := range series {
+		meanX += point.Time.Sub(start).Seconds()
+		meanY += point.Value
+	}
+	n := float64(len(series))
+	meanX /= n
+	meanY /= n
+
+	var covariance, variance float64
+	for _, point := range series {
+		dx := point.Time.Sub(start).Seconds() - meanX
+		covariance += dx * (point.Value - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
+
+// seriesCountAbove returns the number of buckets of the series with a value above the threshold
+func seriesCountAbove(series []seriesPoint, threshold float64) int {
+	count := 0
+	for _, point := range series {
+		if point.Value > threshold {
+			count++
+		}
+	}
+	return count
+}
+
+// seriesFunctions are the functions over series available in conditions. max, min, last and count are expr
+// builtins, so the functions are prefixed or named differently.
+var seriesFunctions = []expr.Option{
+	seriesFunction("seriesMax", seriesMax),
+	seriesFunction("seriesMin", seriesMin),
+	seriesFunction("seriesAvg", seriesAvg),
+	seriesFunction("seriesLast", seriesLast),
+	seriesFunction("slope", seriesSlope),
+	expr.Function("countAbove", func(params ...any) (any, error) {
+		return seriesCountAbove(params[0].([]seriesPoint), params[1].(float64)), nil
+	}, new(func([]seriesPoint, float64) int)),
+}
+
+func seriesFunction(name string, fn func([]seriesPoint) float64) expr.Option {
+	return expr.Function(name, func(params ...any) (any, error) {
+		return fn(params[0].([]seriesPoint)), nil
+	}, new(func([]seriesPoint) float64))
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSeries(values ...float64) []seriesPoint {
+	start := time.Date(2021, 4, 9, 14, 0, 0, 0, time.UTC)
+	series := make([]seriesPoint, len(values))
+	for i, value := range values {
+		series[i] = seriesPoint{Time: start.Add(time.Duration(i) * time.Minute), Value: value}
+	}
+	return series
+}
+
+func TestSeriesFunctions(t *testing.T) {
+	series := newSeries(120, 100, 180, 160)
+	assert.Equal(t, 180.0, seriesMax(series))
+	assert.Equal(t, 100.0, seriesMin(series))
+	assert.Equal(t, 140.0, seriesAvg(series))
+	assert.Equal(t, 160.0, seriesLast(series))
+	assert.Equal(t, 2, seriesCountAbove(series, 150))
+	// least squares line of 120, 100, 180, 160 over 0, 1, 2, 3 minutes
+	assert.InDelta(t, 20.0/60, seriesSlope(series), 1e-9)
+
+	assert.Equal(t, 0.0, seriesMax(nil))
+	assert.Equal(t, 0.0, seriesMin(nil))
+	assert.Equal(t, 0.0, seriesAvg(nil))
+	assert.Equal(t, 0.0, seriesLast(nil))
+	assert.Equal(t, 0.0, seriesSlope(newSeries(120)))
+	assert.Equal(t, 0, seriesCountAbove(nil, 0))
+}
+
+func TestGroupSeries(t *testing.T) {
+	result := &QueryResult{
+		Query: Query{Breakdowns: []string{"service.name"}},
+		Data: QueryResultData{
+			Series: []SeriesDatum{
+				{Time: "2021-04-09T14:17:00Z", Data: map[string]interface{}{"service.name": "api", "COUNT": json.Number("7")}},
+				{Time: "2021-04-09T14:16:00Z", Data: map[string]interface{}{"service.name": "api", "COUNT": json.Number("5")}},
+				{Time: "2021-04-09T14:16:00Z", Data: map[string]interface{}{"service.name": "web", "COUNT": nil}},
+				{Time: "2021-04-09T14:17:00Z", Data: map[string]interface{}{"service.name": "web", "COUNT": json.Number("3")}},
+			},
+		},
+	}
+
+	series, err := groupSeries(result, "COUNT")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]seriesPoint{
+		"service.name=api": {
+			{Time: time.Date(2021, 4, 9, 14, 16, 0, 0, time.UTC), Value: 5},
+			{Time: time.Date(2021, 4, 9, 14, 17, 0, 0, time.UTC), Value: 7},
+		},
+		"service.name=web": {
+			{Time: time.Date(2021, 4, 9, 14, 17, 0, 0, time.UTC), Value: 3},
+		},
+	}, series)
+
+	result.Data.Series[0].Time = "yesterday"
+	_, err = groupSeries(result, "COUNT")
+	assert.EqualError(t, err, `failed to parse series time "yesterday": parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`)
+}
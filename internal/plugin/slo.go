@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	metricutil "github.com/argoproj/argo-rollouts/utils/metric"
+	timeutil "github.com/argoproj/argo-rollouts/utils/time"
+)
+
+const (
+	// HoneycombSLOID is the measurement metadata key of the SLO the measurement evaluated
+	HoneycombSLOID = "HoneycombSLOID"
+	// HoneycombSLOName is the measurement metadata key of the name of the SLO the measurement evaluated
+	HoneycombSLOName = "HoneycombSLOName"
+)
+
+// defaultBurnRateWindow is the window the burn rate of an SLO is calculated over when none is configured
+const defaultBurnRateWindow = "1h"
+
+// SLOSpec references a honeycomb SLO whose budget remaining, burn rate and compliance are evaluated instead of the
+// result of a query
+type SLOSpec struct {
+	// ID is the ID of the SLO
+	ID string `json:"id" protobuf:"bytes,1,opt,name=id"`
+	// BurnRateWindows are the windows the burn rate is calculated over, e.g. 1h. The burn rate of the first window is
+	// burnRate, every burn rate is in burnRates by window. Defaults to 1h.
+	BurnRateWindows []string `json:"burnRateWindows,omitempty" protobuf:"bytes,2,rep,name=burnRateWindows"`
+}
+
+func (s *SLOSpec) validate() error {
+	if s.ID == "" {
+		return errors.New("id must be specified")
+	}
+	for i, window := range s.BurnRateWindows {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return fmt.Errorf("burnRateWindows[%d] is invalid: %w", i, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("burnRateWindows[%d] must be positive", i)
+		}
+		if slices.Contains(s.BurnRateWindows[:i], window) {
+			return fmt.Errorf("burnRateWindows[%d] is defined more than once", i)
+		}
+	}
+	return nil
+}
+
+// burnRateWindows returns the burn rate windows with the default applied
+func (s *SLOSpec) burnRateWindows() []string {
+	if len(s.BurnRateWindows) == 0 {
+		return []string{defaultBurnRateWindow}
+	}
+	return s.BurnRateWindows
+}
+
+// burnRate returns how fast the SLO consumed its error budget over the window ending now, relative to the rate which
+// would exactly exhaust the budget over the time period of the SLO. The budget remaining at the start of the window
+// is taken from the earliest history entry of the window.
+func burnRate(slo *SLO, history []SLOHistory, window time.Duration, now time.Time) (float64, error) {
+	// history timestamps are in seconds
+	start := now.Add(-window).Unix()
+	var first *SLOHistory
+	for i := range history {
+		entry := &history[i]
+		if entry.Timestamp < start {
+			continue
+		}
+		if first == nil || entry.Timestamp < first.Timestamp {
+			first = entry
+		}
+	}
+	if first == nil {
+		return 0, fmt.Errorf("no SLO history in the last %s", window)
+	}
+
+	elapsed := now.Sub(time.Unix(first.Timestamp, 0))
+	if elapsed <= 0 {
+		return 0, fmt.Errorf("no SLO history in the last %s", window)
+	}
+
+	period := time.Duration(slo.TimePeriodDays) * 24 * time.Hour
+	consumed := (first.BudgetRemaining - slo.BudgetRemaining) / 100
+	return consumed * float64(period) / float64(elapsed), nil
+}
+
+// evaluateSLO evaluates the budget remaining, burn rates and compliance of the SLO against the conditions of the metric
+func evaluateSLO(metric v1alpha1.Metric, spec *SLOSpec, slo *SLO, history []SLOHistory, now time.Time) (evaluation, error) {
+	if slo.TimePeriodDays <= 0 {
+		return evaluation{}, fmt.Errorf("SLO %s has no time period", spec.ID)
+	}
+
+	env := envStruct{
+		BudgetRemaining: slo.BudgetRemaining,
+		Compliance:      slo.Compliance,
+		BurnRates:       make(map[string]float64, len(spec.burnRateWindows())),
+	}
+	values := []string{
+		"budgetRemaining=" + strconv.FormatFloat(slo.BudgetRemaining, 'f', -1, 64),
+		"compliance=" + strconv.FormatFloat(slo.Compliance, 'f', -1, 64),
+	}
+	for i, window := range spec.burnRateWindows() {
+		// validated by parseConfig
+		d, _ := time.ParseDuration(window)
+		rate, err := burnRate(slo, history, d, now)
+		if err != nil {
+			return evaluation{}, err
+		}
+		if i == 0 {
+			env.BurnRate = rate
+		}
+		env.BurnRates[window] = rate
+		values = append(values, formatBurnRate(window, rate))
+	}
+
+	e := evaluation{
+		value: strings.Join(values, ", "),
+		metadata: map[string]string{
+			HoneycombSLOID:   spec.ID,
+			HoneycombSLOName: slo.Name,
+		},
+	}
+
+	if metric.SuccessCondition == "" && metric.FailureCondition == "" {
+		e.phase = v1alpha1.AnalysisPhaseSuccessful
+		return e, nil
+	}
+
+	c, err := compileConditions(metric)
+	if err != nil {
+		return e, err
+	}
+	e.phase, err = c.evaluate(env)
+	return e, err
+}
+
+// runSLO measures the SLO of the config. SLOs are read synchronously, so the measurement completes right away.
+func (p *HoneycombProvider) runSLO(metric v1alpha1.Metric, config *Config, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	api, err := p.newConfiguredAPI(ctx, config)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	slo, err := api.GetSLO(ctx, config.SLO.ID, config.Dataset)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	// a single history request covers every window
+	var longest time.Duration
+	for _, window := range config.SLO.burnRateWindows() {
+		d, _ := time.ParseDuration(window)
+		longest = max(longest, d)
+	}
+	now := time.Now()
+	history, err := api.GetSLOHistory(ctx, config.SLO.ID, now.Add(-longest), now)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	e, err := evaluateSLO(metric, config.SLO, slo, history, now)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	measurement.Value = e.value
+	measurement.Phase = e.phase
+	measurement.Metadata = e.metadata
+
+	finishedTime := timeutil.MetaNow()
+	measurement.FinishedAt = &finishedTime
+	return measurement
+}
+
+// formatBurnRate formats the burn rate over a window as part of the value of a measurement
+func formatBurnRate(window string, rate float64) string {
+	return fmt.Sprintf("burnRate(%s)=%s", window, strconv.FormatFloat(rate, 'f', 2, 64))
+}
@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"math"
+	"sort"
+)
+
+// testResult is the outcome of a two-sample significance test
+type testResult struct {
+	// statistic is the test statistic, U for Mann-Whitney and t for Welch
+	statistic float64
+	// pValue is the two-sided p-value of the test
+	pValue float64
+	// effectSize is positive when the first sample tends to be larger than the second
+	effectSize float64
+}
+
+// env returns the result of the test as exposed to conditions
+func (r testResult) env() significanceTest {
+	return significanceTest{
+		Statistic:  r.statistic,
+		PValue:     r.pValue,
+		EffectSize: r.effectSize,
+	}
+}
+
+// noDifference is the result of a test without enough samples to tell the samples apart
+var noDifference = testResult{pValue: 1}
+
+// mannWhitneyU runs the two-sided Mann-Whitney U test of a against b, using the normal approximation with tie and
+// continuity corrections. The statistic is the U of a, the effect size the rank-biserial correlation.
+func mannWhitneyU(a []float64, b []float64) testResult {
+	n1 := float64(len(a))
+	n2 := float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return noDifference
+	}
+
+	type sample struct {
+		value float64
+		first bool
+	}
+	samples := make([]sample, 0, len(a)+len(b))
+	for _, v := range a {
+		samples = append(samples, sample{value: v, first: true})
+	}
+	for _, v := range b {
+		samples = append(samples, sample{value: v})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].value < samples[j].value })
+
+	// tied samples share the average of their ranks
+	var rankSum, ties float64
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].value == samples[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if samples[k].first {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	n := n1 + n2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	result := testResult{
+		statistic:  u,
+		effectSize: 2*u/(n1*n2) - 1,
+	}
+	if variance <= 0 {
+		// every sample is the same
+		result.pValue = 1
+		return result
+	}
+
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	result.pValue = math.Min(1, 2*normalSurvival(z))
+	return result
+}
+
+// welchT runs the two-sided Welch's t-test of a against b. The effect size is Cohen's d using the average of the
+// variances of the samples.
+func welchT(a []float64, b []float64) testResult {
+	if len(a) < 2 || len(b) < 2 {
+		return noDifference
+	}
+
+	m1, v1 := meanVariance(a)
+	m2, v2 := meanVariance(b)
+	n1 := float64(len(a))
+	n2 := float64(len(b))
+	diff := m1 - m2
+
+	se2 := v1/n1 + v2/n2
+	if se2 == 0 {
+		// both samples are constant
+		if diff == 0 {
+			return noDifference
+		}
+		return testResult{
+			statistic:  math.Copysign(math.Inf(1), diff),
+			effectSize: math.Copysign(math.Inf(1), diff),
+		}
+	}
+
+	t := diff / math.Sqrt(se2)
+	df := se2 * se2 / ((v1*v1)/(n1*n1*(n1-1)) + (v2*v2)/(n2*n2*(n2-1)))
+	return testResult{
+		statistic:  t,
+		pValue:     studentTwoSided(t, df),
+		effectSize: diff / math.Sqrt((v1+v2)/2),
+	}
+}
+
+// meanVariance returns the mean and the unbiased variance of the samples
+func meanVariance(samples []float64) (mean float64, variance float64) {
+	for _, v := range samples {
+		mean += v
+	}
+	mean /= float64(len(samples))
+	for _, v := range samples {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(samples) - 1)
+	return mean, variance
+}
+
+// normalSurvival returns P(Z > z) for a standard normal Z
+func normalSurvival(z float64) float64 {
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+// studentTwoSided returns P(|T| > |t|) for T following a Student's t-distribution with df degrees of freedom
+func studentTwoSided(t float64, df float64) float64 {
+	return regularizedIncompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// regularizedIncompleteBeta returns I_x(a, b), evaluated with the continued fraction of Numerical Recipes
+func regularizedIncompleteBeta(a float64, b float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+
+	// the continued fraction converges quickly for x < (a+1)/(a+b+2), use the symmetry of I otherwise
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+	}
+	return front * betaContinuedFraction(a, b, x) / a
+}
+
+func betaContinuedFraction(a float64, b float64, x float64) float64 {
+	const (
+		maxIterations = 200
+		epsilon       = 1e-15
+		tiny          = 1e-300
+	)
+
+	c := 1.0
+	d := 1 - (a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		for _, numerator := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + numerator*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + numerator/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
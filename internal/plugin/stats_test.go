@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        []float64
+		b        []float64
+		expected testResult
+	}{
+		{
+			// scipy.stats.mannwhitneyu(a, b, method="asymptotic")
+			name:     "without ties",
+			a:        []float64{19, 22, 16, 29, 24},
+			b:        []float64{20, 11, 17, 12},
+			expected: testResult{statistic: 17, pValue: 0.111346886533, effectSize: 0.7},
+		},
+		{
+			name:     "with ties",
+			a:        []float64{1, 2, 2, 3, 4},
+			b:        []float64{2, 3, 3, 5, 6, 6},
+			expected: testResult{statistic: 6, pValue: 0.113049978856, effectSize: -0.6},
+		},
+		{
+			name:     "identical samples",
+			a:        []float64{5, 5, 5},
+			b:        []float64{5, 5},
+			expected: testResult{statistic: 3, pValue: 1, effectSize: 0},
+		},
+		{
+			name:     "empty sample",
+			a:        []float64{1, 2},
+			expected: noDifference,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := mannWhitneyU(test.a, test.b)
+			assert.InDelta(t, test.expected.statistic, result.statistic, 1e-9)
+			assert.InDelta(t, test.expected.pValue, result.pValue, 1e-9)
+			assert.InDelta(t, test.expected.effectSize, result.effectSize, 1e-9)
+		})
+	}
+}
+
+func TestWelchT(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        []float64
+		b        []float64
+		expected testResult
+	}{
+		{
+			// https://en.wikipedia.org/wiki/Welch%27s_t-test#Examples, t = -2.46, df = 24.99, p = 0.021
+			name:     "unequal means",
+			a:        []float64{27.5, 21.0, 19.0, 23.6, 17.0, 17.9, 16.9, 20.1, 21.9, 22.6, 23.1, 19.6, 19.0, 21.7, 21.4},
+			b:        []float64{27.1, 22.0, 20.8, 23.4, 23.4, 23.5, 25.8, 22.0, 24.8, 20.2, 21.9, 22.1, 22.9, 20.5, 24.4},
+			expected: testResult{statistic: -2.455356398286, pValue: 0.021378001423, effectSize: -0.896569390704},
+		},
+		{
+			name:     "equal means",
+			a:        []float64{1, 2, 3},
+			b:        []float64{0, 2, 4},
+			expected: testResult{statistic: 0, pValue: 1, effectSize: 0},
+		},
+		{
+			name:     "single sample",
+			a:        []float64{1, 2, 3},
+			b:        []float64{2},
+			expected: noDifference,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := welchT(test.a, test.b)
+			assert.InDelta(t, test.expected.statistic, result.statistic, 1e-9)
+			assert.InDelta(t, test.expected.pValue, result.pValue, 1e-9)
+			assert.InDelta(t, test.expected.effectSize, result.effectSize, 1e-9)
+		})
+	}
+}
+
+func TestWelchTWithConstantSamples(t *testing.T) {
+	result := welchT([]float64{3, 3}, []float64{1, 1, 1})
+	assert.Equal(t, 0.0, result.pValue)
+	assert.True(t, math.IsInf(result.effectSize, 1))
+
+	assert.Equal(t, noDifference, welchT([]float64{3, 3}, []float64{3, 3, 3}))
+}
+
+func TestStudentTwoSided(t *testing.T) {
+	// P(|T| > 2.228) for 10 degrees of freedom, the 97.5th percentile of the t-distribution
+	assert.InDelta(t, 0.05, studentTwoSided(2.228, 10), 1e-4)
+	assert.InDelta(t, 1, studentTwoSided(0, 10), 1e-12)
+	assert.InDelta(t, 2*normalSurvival(1.96), studentTwoSided(1.96, 1e6), 1e-5)
+}
@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Argo Rollouts resolves the {{args.*}} of the whole metric and fails on any other {{ }}, so queries are
+	// rendered with different delimiters
+	templateLeftDelim  = "[["
+	templateRightDelim = "]]"
+)
+
+// queryContext is the AnalysisRun context queries are rendered with, e.g. [[ .PodTemplateHash ]]
+type queryContext struct {
+	// Namespace is the namespace of the AnalysisRun
+	Namespace string
+	// Rollout is the name of the Rollout which owns the AnalysisRun, if any
+	Rollout string
+	// AnalysisRun is the name of the AnalysisRun
+	AnalysisRun string
+	// PodTemplateHash is the rollouts-pod-template-hash of the ReplicaSet the AnalysisRun was started for
+	PodTemplateHash string
+	// Labels are the labels of the AnalysisRun, which include the selector of the Rollout
+	Labels map[string]string
+	// Metric is the name of the metric
+	Metric string
+	// Interval is the interval of the metric, e.g. 5m
+	Interval string
+	// IntervalSeconds is the interval of the metric in seconds, e.g. to use as the time_range of the query
+	IntervalSeconds int
+}
+
+func newQueryContext(run *v1alpha1.AnalysisRun, metric v1alpha1.Metric) (*queryContext, error) {
+	if run == nil {
+		return nil, nil
+	}
+
+	qc := &queryContext{
+		Namespace:       run.Namespace,
+		AnalysisRun:     run.Name,
+		PodTemplateHash: run.Labels[v1alpha1.DefaultRolloutUniqueLabelKey],
+		Labels:          run.Labels,
+		Metric:          metric.Name,
+		Interval:        string(metric.Interval),
+	}
+	if owner := metav1.GetControllerOf(run); owner != nil && owner.Kind == "Rollout" {
+		qc.Rollout = owner.Name
+	}
+	if metric.Interval != "" {
+		interval, err := metric.Interval.Duration()
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %w", metric.Interval, err)
+		}
+		qc.IntervalSeconds = int(interval.Seconds())
+	}
+	return qc, nil
+}
+
+// renderQuery renders the query with the AnalysisRun context. Without a context the query is returned as is.
+func renderQuery(query string, qc *queryContext) (string, error) {
+	if qc == nil || !strings.Contains(query, templateLeftDelim) {
+		return query, nil
+	}
+
+	t, err := template.New("query").Delims(templateLeftDelim, templateRightDelim).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse query template: %w", err)
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, qc); err != nil {
+		return "", fmt.Errorf("failed to render query template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// renderQuerySpec renders every string value of the query specification with the AnalysisRun context. Strings are
+// rendered before the query is marshalled, which would otherwise escape the quotes of the template actions, e.g.
+// [[ index .Labels "app" ]]. Without a context the query is returned as is.
+func renderQuerySpec(q *Query, qc *queryContext) (*Query, error) {
+	if qc == nil {
+		return q, nil
+	}
+
+	var err error
+	render := func(s string) string {
+		if err != nil {
+			return s
+		}
+		var rendered string
+		rendered, err = renderQuery(s, qc)
+		return rendered
+	}
+	renderColumn := func(column *string) *string {
+		if column == nil {
+			return nil
+		}
+		rendered := render(*column)
+		return &rendered
+	}
+
+	rendered := *q
+	rendered.Breakdowns = make([]string, len(q.Breakdowns))
+	for i, breakdown := range q.Breakdowns {
+		rendered.Breakdowns[i] = render(breakdown)
+	}
+	rendered.Calculations = make([]Calculation, len(q.Calculations))
+	for i, calculation := range q.Calculations {
+		calculation.Column = renderColumn(calculation.Column)
+		rendered.Calculations[i] = calculation
+	}
+	rendered.Filters = make([]Filter, len(q.Filters))
+	for i, filter := range q.Filters {
+		filter.Column = renderColumn(filter.Column)
+		switch value := filter.Value.(type) {
+		case string:
+			filter.Value = render(value)
+		case []interface{}:
+			values := make([]interface{}, len(value))
+			for j, v := range value {
+				if s, ok := v.(string); ok {
+					v = render(s)
+				}
+				values[j] = v
+			}
+			filter.Value = values
+		}
+		rendered.Filters[i] = filter
+	}
+	rendered.Orders = make([]Order, len(q.Orders))
+	for i, order := range q.Orders {
+		order.Column = render(order.Column)
+		rendered.Orders[i] = order
+	}
+	rendered.Havings = make([]Having, len(q.Havings))
+	for i, having := range q.Havings {
+		having.Column = renderColumn(having.Column)
+		rendered.Havings[i] = having
+	}
+	rendered.CalculatedFields = make([]CalculatedField, len(q.CalculatedFields))
+	for i, field := range q.CalculatedFields {
+		field.Name = render(field.Name)
+		field.Expression = render(field.Expression)
+		rendered.CalculatedFields[i] = field
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
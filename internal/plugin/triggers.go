@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	metricutil "github.com/argoproj/argo-rollouts/utils/metric"
+	timeutil "github.com/argoproj/argo-rollouts/utils/time"
+)
+
+const (
+	// HoneycombTriggerName is the measurement metadata key of the name of a trigger, suffixed with its ID
+	HoneycombTriggerName = "HoneycombTriggerName"
+	// HoneycombTriggerThreshold is the measurement metadata key of the threshold of a trigger, suffixed with its ID
+	HoneycombTriggerThreshold = "HoneycombTriggerThreshold"
+	// HoneycombTriggerDisabled is the measurement metadata key set to true for a disabled trigger, suffixed with its ID
+	HoneycombTriggerDisabled = "HoneycombTriggerDisabled"
+)
+
+// validateTriggers checks that the trigger IDs are set and unique
+func validateTriggers(triggers []string) error {
+	for i, id := range triggers {
+		if id == "" {
+			return fmt.Errorf("triggers[%d] must be specified", i)
+		}
+		if slices.Contains(triggers[:i], id) {
+			return fmt.Errorf("trigger %s is referenced more than once", id)
+		}
+	}
+	return nil
+}
+
+// formatThreshold formats the threshold of a trigger, e.g. > 100
+func formatThreshold(threshold TriggerThreshold) string {
+	return threshold.Op + " " + strconv.FormatFloat(threshold.Value, 'f', -1, 64)
+}
+
+// evaluateTriggers fails when any of the triggers is triggered. The value of the measurement is the number of
+// triggered triggers. Disabled triggers are not evaluated by honeycomb, so they are not checked, and the measurement is
+// inconclusive when every trigger is disabled.
+func evaluateTriggers(triggers []*Trigger) evaluation {
+	e := evaluation{
+		metadata: make(map[string]string, 2*len(triggers)),
+	}
+
+	var triggered, disabled []string
+	for _, trigger := range triggers {
+		threshold := formatThreshold(trigger.Threshold)
+		e.metadata[roleKey(HoneycombTriggerName, trigger.ID)] = trigger.Name
+		e.metadata[roleKey(HoneycombTriggerThreshold, trigger.ID)] = threshold
+		switch {
+		case trigger.Disabled:
+			e.metadata[roleKey(HoneycombTriggerDisabled, trigger.ID)] = "true"
+			disabled = append(disabled, trigger.Name)
+		case trigger.Triggered:
+			triggered = append(triggered, fmt.Sprintf("%s (%s)", trigger.Name, threshold))
+		}
+	}
+
+	var messages []string
+	if len(triggered) > 0 {
+		messages = append(messages, fmt.Sprintf("%d of %d triggers triggered: %s", len(triggered), len(triggers), strings.Join(triggered, "; ")))
+	}
+	if len(disabled) > 0 {
+		messages = append(messages, fmt.Sprintf("%d of %d triggers disabled: %s", len(disabled), len(triggers), strings.Join(disabled, "; ")))
+	}
+
+	e.value = strconv.Itoa(len(triggered))
+	e.message = strings.Join(messages, ", ")
+	switch {
+	case len(triggered) > 0:
+		e.phase = v1alpha1.AnalysisPhaseFailed
+	case len(disabled) == len(triggers):
+		e.phase = v1alpha1.AnalysisPhaseInconclusive
+	default:
+		e.phase = v1alpha1.AnalysisPhaseSuccessful
+	}
+	return e
+}
+
+// runTriggers measures the triggers of the config. Triggers are read synchronously, so the measurement completes
+// right away.
+func (p *HoneycombProvider) runTriggers(config *Config, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+
+	api, err := p.newConfiguredAPI(ctx, config)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+
+	triggers := make([]*Trigger, len(config.Triggers))
+	for i, id := range config.Triggers {
+		triggers[i], err = api.GetTrigger(ctx, id, config.Dataset)
+		if err != nil {
+			return metricutil.MarkMeasurementError(measurement, err)
+		}
+	}
+
+	e := evaluateTriggers(triggers)
+	measurement.Value = e.value
+	measurement.Phase = e.phase
+	measurement.Message = e.message
+	measurement.Metadata = e.metadata
+
+	finishedTime := timeutil.MetaNow()
+	measurement.FinishedAt = &finishedTime
+	return measurement
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+const (
+	// HoneycombWindowStart is the measurement metadata key of the start of the window queried in window mode
+	HoneycombWindowStart = "HoneycombWindowStart"
+	// HoneycombWindowEnd is the measurement metadata key of the end of the window queried in window mode
+	HoneycombWindowEnd = "HoneycombWindowEnd"
+)
+
+// Window makes every measurement query the events since the previous measurement, instead of the time_range of the
+// query, so that measurements do not overlap and events from before the analysis are left out
+type Window struct {
+	// IngestionLag is how long events take to be queryable in honeycomb, e.g. 30s. Windows end that long before the
+	// measurement is taken.
+	IngestionLag string `json:"ingestionLag,omitempty" protobuf:"bytes,1,opt,name=ingestionLag"`
+}
+
+func (w *Window) validate() error {
+	if w.IngestionLag == "" {
+		return nil
+	}
+	lag, err := time.ParseDuration(w.IngestionLag)
+	if err != nil {
+		return fmt.Errorf("ingestionLag is invalid: %w", err)
+	}
+	if lag < 0 {
+		return errors.New("ingestionLag cannot be negative")
+	}
+	return nil
+}
+
+func (w *Window) ingestionLag() time.Duration {
+	// validated by parseConfig
+	lag, _ := time.ParseDuration(w.IngestionLag)
+	return lag
+}
+
+// timeWindow is the time range queried by a measurement, in whole seconds as honeycomb expects
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func (tw timeWindow) empty() bool {
+	return !tw.end.After(tw.start)
+}
+
+// measurementWindow returns the window of the measurement of the metric taken at now. It starts where the window of
+// the previous measurement ended, or at the start of the AnalysisRun less the ingestion lag for the first
+// measurement, and ends at now, less the ingestion lag.
+func (w *Window) measurementWindow(run *v1alpha1.AnalysisRun, metric string, now time.Time) (timeWindow, error) {
+	start, err := windowStart(run, metric, w.ingestionLag())
+	if err != nil {
+		return timeWindow{}, err
+	}
+	tw := timeWindow{
+		start: start.UTC().Truncate(time.Second),
+		end:   now.Add(-w.ingestionLag()).UTC().Truncate(time.Second),
+	}
+	if tw.end.Equal(tw.start) {
+		// a measurement taken within the second the AnalysisRun started queries the shortest window honeycomb supports
+		tw.end = tw.start.Add(time.Second)
+	}
+	return tw, nil
+}
+
+// windowStart returns where the window of the previous measurement of the metric ended. Measurements which errored
+// did not evaluate their window, so the next measurement queries it again.
+func windowStart(run *v1alpha1.AnalysisRun, metric string, lag time.Duration) (time.Time, error) {
+	if run == nil {
+		return time.Time{}, errors.New("window requires an AnalysisRun")
+	}
+
+	for _, result := range run.Status.MetricResults {
+		if result.Name != metric {
+			continue
+		}
+		for i := len(result.Measurements) - 1; i >= 0; i-- {
+			previous := result.Measurements[i]
+			if previous.Phase == v1alpha1.AnalysisPhaseError {
+				continue
+			}
+			if end, ok := previous.Metadata[HoneycombWindowEnd]; ok {
+				t, err := time.Parse(time.RFC3339, end)
+				if err != nil {
+					return time.Time{}, fmt.Errorf("failed to parse the window of the previous measurement: %w", err)
+				}
+				return t, nil
+			}
+			if previous.FinishedAt != nil {
+				return previous.FinishedAt.Add(-lag), nil
+			}
+		}
+	}
+
+	// windows end the ingestion lag before the measurement, so the first one starts the ingestion lag before the
+	// AnalysisRun
+	if run.Status.StartedAt != nil {
+		return run.Status.StartedAt.Add(-lag), nil
+	}
+	if !run.CreationTimestamp.IsZero() {
+		return run.CreationTimestamp.Add(-lag), nil
+	}
+	return time.Time{}, errors.New("unable to determine when the AnalysisRun started")
+}
+
+// withWindow replaces the time range of a raw honeycomb query with the window
+func withWindow(query string, tw timeWindow) (string, error) {
+	return updateQuery(query, func(q map[string]interface{}) error {
+		delete(q, "time_range")
+		q["start_time"] = tw.start.Unix()
+		q["end_time"] = tw.end.Unix()
+		return nil
+	})
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/argoproj-labs/rollouts-plugin-metric-honeycomb/internal/plugin"
 	rolloutsPlugin "github.com/argoproj/argo-rollouts/metricproviders/plugin/rpc"
 	goPlugin "github.com/hashicorp/go-plugin"
@@ -20,9 +22,9 @@ var handshakeConfig = goPlugin.HandshakeConfig{
 func main() {
 	logCtx := *log.WithFields(log.Fields{"plugin": "honeycomb"})
 
-	rpcPluginImp := &plugin.HoneycombProvider{
-		LogCtx: logCtx,
-	}
+	rpcPluginImp := plugin.NewHoneycombProvider(logCtx)
+	// e.g. https://api.eu1.honeycomb.io for teams in the EU region
+	rpcPluginImp.DefaultAPIURL = os.Getenv(plugin.APIURLEnvVar)
 	// pluginMap is the map of plugins we can dispense.
 	pluginMap := map[string]goPlugin.Plugin{
 		"RpcMetricProviderPlugin": &rolloutsPlugin.RpcMetricProviderPlugin{Impl: rpcPluginImp},